@@ -0,0 +1,25 @@
+//go:build linux && !386
+// +build linux,!386
+
+package sockopt
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// getLinger is SO_LINGER in seconds, -1 when off. syscall has no getter for
+// the struct.
+func getLinger(fd int) (int, error) {
+	var l syscall.Linger
+	n := uint32(unsafe.Sizeof(l))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), syscall.SOL_SOCKET, syscall.SO_LINGER,
+		uintptr(unsafe.Pointer(&l)), uintptr(unsafe.Pointer(&n)), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	if l.Onoff == 0 {
+		return -1, nil
+	}
+	return int(l.Linger), nil
+}
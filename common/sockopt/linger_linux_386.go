@@ -0,0 +1,6 @@
+package sockopt
+
+// getLinger is not read on 386, getsockopt goes through socketcall there.
+func getLinger(fd int) (int, error) {
+	return 0, ErrUnsupported
+}
@@ -0,0 +1,104 @@
+// Package sockopt applies the socket tuning options of imserver and imclient
+// to tcp connections and reads back what the kernel made of them: the kernel
+// doubles the buffer sizes and clamps them to its limits, so the configured
+// value is not what a connection gets.
+package sockopt
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+var (
+	ErrUnsupported = errors.New("sockopt: not supported on this system")
+)
+
+// Options to apply, zero values keep the system defaults except NoDelay.
+type Options struct {
+	Sndbuf            int           // SO_SNDBUF
+	Rcvbuf            int           // SO_RCVBUF
+	NoDelay           bool          // TCP_NODELAY
+	KeepAlive         time.Duration // idle time before the first probe, 0 turns keepalive off
+	KeepAliveInterval time.Duration // between probes (TCP_KEEPINTVL)
+	KeepAliveCount    int           // unanswered probes before the connection drops (TCP_KEEPCNT)
+	Linger            int           // SO_LINGER seconds, < 0 keeps the default close
+}
+
+// Effective is what a connection has.
+type Effective struct {
+	Sndbuf            int
+	Rcvbuf            int
+	NoDelay           bool
+	KeepAlive         bool
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+	Linger            int // seconds, -1 when off
+}
+
+func (e *Effective) String() string {
+	return fmt.Sprintf("sndbuf: %d rcvbuf: %d nodelay: %t keepalive: %t idle: %v interval: %v count: %d linger: %d",
+		e.Sndbuf, e.Rcvbuf, e.NoDelay, e.KeepAlive, e.KeepAliveIdle, e.KeepAliveInterval, e.KeepAliveCount, e.Linger)
+}
+
+// Apply sets o on conn, it stops at the first option the system refuses.
+func Apply(conn *net.TCPConn, o *Options) (err error) {
+	if o.Sndbuf > 0 {
+		if err = conn.SetWriteBuffer(o.Sndbuf); err != nil {
+			return
+		}
+	}
+	if o.Rcvbuf > 0 {
+		if err = conn.SetReadBuffer(o.Rcvbuf); err != nil {
+			return
+		}
+	}
+	if err = conn.SetNoDelay(o.NoDelay); err != nil {
+		return
+	}
+	if o.Linger >= 0 {
+		if err = conn.SetLinger(o.Linger); err != nil {
+			return
+		}
+	}
+	if o.KeepAlive <= 0 {
+		return conn.SetKeepAlive(false)
+	}
+	if err = conn.SetKeepAlive(true); err != nil {
+		return
+	}
+	// it sets the interval too on most systems, the probes go after it.
+	if err = conn.SetKeepAlivePeriod(o.KeepAlive); err != nil {
+		return
+	}
+	return setKeepAliveProbes(conn, o.KeepAliveInterval, o.KeepAliveCount)
+}
+
+// Dial connects to addr and applies o.
+func Dial(addr string, o *Options) (*net.TCPConn, error) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := c.(*net.TCPConn)
+	if err = Apply(conn, o); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// control runs fn on the descriptor of conn.
+func control(conn *net.TCPConn, fn func(fd int) error) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err = raw.Control(func(fd uintptr) { ferr = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return ferr
+}
@@ -0,0 +1,60 @@
+package sockopt
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+func setKeepAliveProbes(conn *net.TCPConn, interval time.Duration, count int) error {
+	return control(conn, func(fd int) error {
+		if secs := int(interval / time.Second); secs > 0 {
+			if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs); err != nil {
+				return err
+			}
+		}
+		if count > 0 {
+			return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count)
+		}
+		return nil
+	})
+}
+
+// Read returns the options conn has now.
+func Read(conn *net.TCPConn) (*Effective, error) {
+	e := new(Effective)
+	err := control(conn, func(fd int) (err error) {
+		if e.Sndbuf, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF); err != nil {
+			return
+		}
+		if e.Rcvbuf, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF); err != nil {
+			return
+		}
+		var v int
+		if v, err = syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); err != nil {
+			return
+		}
+		e.NoDelay = v != 0
+		if v, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); err != nil {
+			return
+		}
+		e.KeepAlive = v != 0
+		if v, err = syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); err != nil {
+			return
+		}
+		e.KeepAliveIdle = time.Duration(v) * time.Second
+		if v, err = syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL); err != nil {
+			return
+		}
+		e.KeepAliveInterval = time.Duration(v) * time.Second
+		if e.KeepAliveCount, err = syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT); err != nil {
+			return
+		}
+		e.Linger, err = getLinger(fd)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
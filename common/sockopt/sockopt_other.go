@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package sockopt
+
+import (
+	"net"
+	"time"
+)
+
+// setKeepAliveProbes leaves interval and count to the system, only
+// SetKeepAlivePeriod is portable.
+func setKeepAliveProbes(conn *net.TCPConn, interval time.Duration, count int) error {
+	return nil
+}
+
+// Read returns the options conn has now, linux only.
+func Read(conn *net.TCPConn) (*Effective, error) {
+	return nil, ErrUnsupported
+}
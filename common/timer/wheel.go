@@ -0,0 +1,143 @@
+// Package timer is a hashed timing wheel for the many long, rarely firing
+// per connection timers of imserver: heartbeat expiry, handshake and ack
+// timeouts. Adding, resetting and stopping a timer is O(1) under one mutex
+// and reuses the Timer, a time.Timer per connection costs a runtime timer
+// and a channel or goroutine each.
+package timer
+
+import (
+	"sync"
+	"time"
+)
+
+// Wheel has slots buckets of timers, the hand moves one slot every tick.
+// A timer further than a turn away waits the turns out in its slot.
+// The hand follows the clock, not the ticker: a late tick moves it over
+// every slot it missed, so timers never fire early, and about a tick late.
+type Wheel struct {
+	tick  time.Duration
+	lock  sync.Mutex
+	slots []Timer // list heads
+	start time.Time
+	hand  int64 // ticks since start done
+	stop  chan struct{}
+}
+
+// Timer is a timer of a Wheel, its fn runs on the wheel goroutine and must
+// not block, hand slow work to a goroutine.
+type Timer struct {
+	w          *Wheel
+	fn         func()
+	slot       int
+	rounds     int
+	prev, next *Timer // nil when not scheduled
+}
+
+// New starts a wheel of slots slots moving every tick.
+func New(tick time.Duration, slots int) *Wheel {
+	if tick <= 0 {
+		tick = time.Millisecond
+	}
+	if slots <= 0 {
+		slots = 1
+	}
+	w := &Wheel{tick: tick, slots: make([]Timer, slots), start: time.Now(), stop: make(chan struct{})}
+	for i := range w.slots {
+		head := &w.slots[i]
+		head.prev, head.next = head, head
+	}
+	go w.run()
+	return w
+}
+
+// AfterFunc runs fn once d has passed, unless the Timer is stopped first.
+func (w *Wheel) AfterFunc(d time.Duration, fn func()) *Timer {
+	t := &Timer{w: w, fn: fn}
+	w.lock.Lock()
+	w.add(t, d)
+	w.lock.Unlock()
+	return t
+}
+
+// Stop the wheel, pending timers never fire.
+func (w *Wheel) Stop() {
+	close(w.stop)
+}
+
+// add links t in the slot of the first tick d from now, w.lock held.
+func (w *Wheel) add(t *Timer, d time.Duration) {
+	due := int64((time.Since(w.start) + d + w.tick - 1) / w.tick)
+	if due <= w.hand {
+		due = w.hand + 1
+	}
+	n := int64(len(w.slots))
+	t.slot = int(due % n)
+	t.rounds = int((due - w.hand - 1) / n)
+	head := &w.slots[t.slot]
+	t.prev, t.next = head.prev, head
+	head.prev.next = t
+	head.prev = t
+}
+
+// del unlinks t, w.lock held.
+func (w *Wheel) del(t *Timer) bool {
+	if t.next == nil {
+		return false
+	}
+	t.prev.next = t.next
+	t.next.prev = t.prev
+	t.prev, t.next = nil, nil
+	return true
+}
+
+func (w *Wheel) run() {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	var fns []func()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.stop:
+			return
+		}
+		w.lock.Lock()
+		for now := int64(time.Since(w.start) / w.tick); w.hand < now; {
+			w.hand++
+			head := &w.slots[w.hand%int64(len(w.slots))]
+			for t := head.next; t != head; {
+				next := t.next
+				if t.rounds > 0 {
+					t.rounds--
+				} else {
+					w.del(t)
+					fns = append(fns, t.fn)
+				}
+				t = next
+			}
+		}
+		w.lock.Unlock()
+		for i, fn := range fns {
+			fn()
+			fns[i] = nil
+		}
+		fns = fns[:0]
+	}
+}
+
+// Stop keeps t from firing, it reports whether t was still pending.
+func (t *Timer) Stop() bool {
+	t.w.lock.Lock()
+	ok := t.w.del(t)
+	t.w.lock.Unlock()
+	return ok
+}
+
+// Reset schedules t d from now whether it fired, was stopped or is still
+// pending, it reports whether it was pending.
+func (t *Timer) Reset(d time.Duration) bool {
+	t.w.lock.Lock()
+	ok := t.w.del(t)
+	t.w.add(t, d)
+	t.w.lock.Unlock()
+	return ok
+}
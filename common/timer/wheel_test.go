@@ -0,0 +1,250 @@
+package timer
+
+import (
+	"runtime"
+	"testing"
+	"time"
+)
+
+const (
+	testTick  = 2 * time.Millisecond
+	testSlots = 4 // a turn is 8ms, longer timers wait rounds out
+	testWait  = 2 * time.Second
+)
+
+func newTestWheel(t *testing.T) *Wheel {
+	w := New(testTick, testSlots)
+	t.Cleanup(w.Stop)
+	return w
+}
+
+// after arms a timer on w, the channel gets the time it fired.
+func after(w *Wheel, d time.Duration) (*Timer, time.Time, chan time.Time) {
+	fired := make(chan time.Time, 1)
+	armed := time.Now()
+	return w.AfterFunc(d, func() { fired <- time.Now() }), armed, fired
+}
+
+// waitFired fails unless the timer fires, and not before at.
+func waitFired(t *testing.T, fired chan time.Time, at time.Time) {
+	t.Helper()
+	select {
+	case when := <-fired:
+		if when.Before(at) {
+			t.Errorf("fired %v early", at.Sub(when))
+		}
+	case <-time.After(time.Until(at) + testWait):
+		t.Fatalf("not fired %v after it was due", testWait)
+	}
+}
+
+func notFired(t *testing.T, fired chan time.Time) {
+	t.Helper()
+	select {
+	case <-fired:
+		t.Error("fired")
+	case <-time.After(4 * testSlots * testTick):
+	}
+}
+
+func TestAfterFunc(t *testing.T) {
+	tests := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"zero", 0},
+		{"part of a tick", testTick / 2},
+		{"one tick", testTick},
+		{"ticks and a part", 2*testTick + testTick/2},
+		{"one turn", testSlots * testTick},
+		{"rounds", 3*testSlots*testTick + testTick},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			w := newTestWheel(t)
+			for i := 0; i < 20; i++ {
+				_, armed, fired := after(w, tt.d)
+				waitFired(t, fired, armed.Add(tt.d))
+			}
+		})
+	}
+}
+
+func TestStop(t *testing.T) {
+	w := newTestWheel(t)
+	tm, _, fired := after(w, 3*testSlots*testTick)
+	if !tm.Stop() {
+		t.Error("Stop() of a pending timer = false")
+	}
+	if tm.Stop() {
+		t.Error("Stop() of a stopped timer = true")
+	}
+	notFired(t, fired)
+
+	tm, armed, fired := after(w, testTick)
+	waitFired(t, fired, armed.Add(testTick))
+	if tm.Stop() {
+		t.Error("Stop() of a fired timer = true")
+	}
+}
+
+func TestReset(t *testing.T) {
+	const d = 2*testSlots*testTick + testTick
+	tests := []struct {
+		name string
+		prep func(t *testing.T, tm *Timer, fired chan time.Time)
+		want bool
+	}{
+		{"pending", func(*testing.T, *Timer, chan time.Time) {}, true},
+		{"fired", func(t *testing.T, _ *Timer, fired chan time.Time) { <-fired }, false},
+		{"stopped", func(_ *testing.T, tm *Timer, _ chan time.Time) { tm.Stop() }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			w := newTestWheel(t)
+			tm, _, fired := after(w, testTick)
+			tt.prep(t, tm, fired)
+			reset := time.Now()
+			if ok := tm.Reset(d); ok != tt.want {
+				t.Errorf("Reset() = %v, want %v", ok, tt.want)
+			}
+			waitFired(t, fired, reset.Add(d))
+			notFired(t, fired)
+		})
+	}
+}
+
+func TestResetInFn(t *testing.T) {
+	const times = 5
+	var (
+		n    int // fn runs on the wheel goroutine only
+		done = make(chan struct{})
+	)
+	w := newTestWheel(t)
+	tm := w.AfterFunc(time.Hour, func() {})
+	tm.fn = func() {
+		if n++; n == times {
+			close(done)
+			return
+		}
+		if tm.Reset(testSlots * testTick) {
+			t.Error("Reset() in fn = true")
+		}
+	}
+	tm.Reset(testTick)
+	select {
+	case <-done:
+	case <-time.After(testWait):
+		t.Fatalf("fn did not run %d times", times)
+	}
+	if tm.Stop() {
+		t.Error("Stop() after the last fn = true")
+	}
+}
+
+// compares the wheel with time.AfterFunc on what imserver does with its
+// timers: arm one per connection, push it back on every frame, stop it on
+// close. BenchmarkHold holds b.N idle timers at once and reports the memory
+// they take.
+//
+//	go test -bench . -benchmem
+
+func nop() {}
+
+func newBenchWheel(b *testing.B) *Wheel {
+	w := New(100*time.Millisecond, 1024)
+	b.Cleanup(w.Stop)
+	b.ResetTimer()
+	return w
+}
+
+func BenchmarkAddStop(b *testing.B) {
+	b.Run("wheel", func(b *testing.B) {
+		b.ReportAllocs()
+		w := newBenchWheel(b)
+		for i := 0; i < b.N; i++ {
+			w.AfterFunc(90*time.Second, nop).Stop()
+		}
+	})
+	b.Run("time", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			time.AfterFunc(90*time.Second, nop).Stop()
+		}
+	})
+}
+
+func BenchmarkReset(b *testing.B) {
+	b.Run("wheel", func(b *testing.B) {
+		b.ReportAllocs()
+		t := newBenchWheel(b).AfterFunc(90*time.Second, nop)
+		for i := 0; i < b.N; i++ {
+			t.Reset(90 * time.Second)
+		}
+		t.Stop()
+	})
+	b.Run("time", func(b *testing.B) {
+		b.ReportAllocs()
+		t := time.AfterFunc(90*time.Second, nop)
+		for i := 0; i < b.N; i++ {
+			t.Reset(90 * time.Second)
+		}
+		t.Stop()
+	})
+}
+
+func BenchmarkResetParallel(b *testing.B) {
+	b.Run("wheel", func(b *testing.B) {
+		b.ReportAllocs()
+		w := newBenchWheel(b)
+		b.RunParallel(func(pb *testing.PB) {
+			t := w.AfterFunc(90*time.Second, nop)
+			for pb.Next() {
+				t.Reset(90 * time.Second)
+			}
+			t.Stop()
+		})
+	})
+	b.Run("time", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			t := time.AfterFunc(90*time.Second, nop)
+			for pb.Next() {
+				t.Reset(90 * time.Second)
+			}
+			t.Stop()
+		})
+	})
+}
+
+func BenchmarkHold(b *testing.B) {
+	b.Run("wheel", func(b *testing.B) {
+		w := newBenchWheel(b)
+		hold(b, func(d time.Duration) func() bool { return w.AfterFunc(d, nop).Stop })
+	})
+	b.Run("time", func(b *testing.B) {
+		hold(b, func(d time.Duration) func() bool { return time.AfterFunc(d, nop).Stop })
+	})
+}
+
+// hold arms b.N timers spread over heartbeat like deadlines and reports
+// the heap they keep alive.
+func hold(b *testing.B, arm func(d time.Duration) func() bool) {
+	var before, after runtime.MemStats
+	stops := make([]func() bool, b.N)
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := range stops {
+		stops[i] = arm(60*time.Second + time.Duration(i%30000)*time.Millisecond)
+	}
+	b.StopTimer()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(b.N), "B/timer")
+	for _, stop := range stops {
+		stop()
+	}
+}
@@ -0,0 +1,64 @@
+package token
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	ErrRevoked     = errors.New("token: revoked")
+	ErrNoBlacklist = errors.New("token: no blacklist to revoke in")
+)
+
+// revokedKey a revoked token is kept in redis by its hash until it expires.
+func revokedKey(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return "token:revoked:" + hex.EncodeToString(h[:])
+}
+
+// Verifier verifies tokens and checks them against the redis blacklist,
+// Pool nil skips the blacklist.
+type Verifier struct {
+	Key  []byte
+	Pool *redis.Pool
+}
+
+// Verify the token at now, the blacklist is only asked about tokens with a
+// good signature.
+func (v *Verifier) Verify(token string, now time.Time) (*Claims, error) {
+	c, err := Verify(v.Key, token, now)
+	if err != nil || v.Pool == nil {
+		return c, err
+	}
+	conn := v.Pool.Get()
+	defer conn.Close()
+	revoked, err := redis.Bool(conn.Do("EXISTS", revokedKey(token)))
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return c, ErrRevoked
+	}
+	return c, nil
+}
+
+// Revoke blacklists the token until it expires, a bad or expired token
+// has nothing to revoke.
+func (v *Verifier) Revoke(token string, now time.Time) error {
+	if v.Pool == nil {
+		return ErrNoBlacklist
+	}
+	c, err := Verify(v.Key, token, now)
+	if err != nil {
+		return err
+	}
+	ttl := int64((c.Expire.Sub(now) + time.Second - 1) / time.Second)
+	conn := v.Pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("SET", revokedKey(token), 1, "EX", ttl)
+	return err
+}
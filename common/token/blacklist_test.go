@@ -0,0 +1,89 @@
+package token
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// fakeConn is a redis connection that answers SET and EXISTS from a map,
+// the TTLs of SET ... EX are recorded but never expire.
+type fakeConn struct {
+	keys map[string]int64 // key to its ttl
+}
+
+func (c *fakeConn) Close() error                      { return nil }
+func (c *fakeConn) Err() error                        { return nil }
+func (c *fakeConn) Send(string, ...interface{}) error { return nil }
+func (c *fakeConn) Flush() error                      { return nil }
+func (c *fakeConn) Receive() (interface{}, error)     { return nil, nil }
+
+func (c *fakeConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	switch cmd {
+	case "SET":
+		c.keys[args[0].(string)] = args[3].(int64)
+		return "OK", nil
+	case "EXISTS":
+		if _, ok := c.keys[args[0].(string)]; ok {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	}
+	return nil, redis.Error("ERR unknown command " + cmd)
+}
+
+func newTestVerifier() (*Verifier, *fakeConn) {
+	conn := &fakeConn{keys: make(map[string]int64)}
+	pool := &redis.Pool{Dial: func() (redis.Conn, error) { return conn, nil }}
+	return &Verifier{Key: testKey, Pool: pool}, conn
+}
+
+func TestRevoke(t *testing.T) {
+	token := Sign(testKey, testClaim)
+	tests := []struct {
+		name string
+		now  time.Time
+		ttl  int64
+		want error
+	}{
+		{"an hour left", testNow, 3600, nil},
+		{"part of a second left", testClaim.Expire.Add(-time.Millisecond), 1, nil},
+		{"seconds and a part left", testClaim.Expire.Add(-2500 * time.Millisecond), 3, nil},
+		{"expired", testClaim.Expire, 0, ErrExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, conn := newTestVerifier()
+			if err := v.Revoke(token, tt.now); err != tt.want {
+				t.Fatalf("Revoke() error(%v), want %v", err, tt.want)
+			}
+			if tt.want != nil {
+				if len(conn.keys) != 0 {
+					t.Errorf("%d keys set", len(conn.keys))
+				}
+				return
+			}
+			if ttl := conn.keys[revokedKey(token)]; ttl != tt.ttl {
+				t.Errorf("ttl %d, want %d", ttl, tt.ttl)
+			}
+			if _, err := v.Verify(token, tt.now); err != ErrRevoked {
+				t.Errorf("Verify() error(%v), want %v", err, ErrRevoked)
+			}
+		})
+	}
+	if err := (&Verifier{Key: testKey}).Revoke(token, testNow); err != ErrNoBlacklist {
+		t.Errorf("Revoke() without a pool error(%v), want %v", err, ErrNoBlacklist)
+	}
+}
+
+func TestVerifierVerify(t *testing.T) {
+	v, _ := newTestVerifier()
+	token := Sign(testKey, testClaim)
+	if _, err := v.Verify(token, testNow); err != nil {
+		t.Errorf("Verify() error(%v)", err)
+	}
+	if _, err := v.Verify(flip(token, 2), testNow); err != ErrSignature {
+		t.Errorf("Verify() of a tampered token error(%v), want %v", err, ErrSignature)
+	}
+}
@@ -0,0 +1,80 @@
+// Package token signs and verifies the IM login tokens clients send in
+// OP_AUTH. A token is base64url(payload) "." base64url(hmac-sha256(payload)),
+// the payload holds the user ID, issue and expire times and the device.
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	payloadLen = 4 + 8 + 8 // userID, issuedAt, expire, then the device
+)
+
+var (
+	ErrToken     = errors.New("token: malformed")
+	ErrSignature = errors.New("token: bad signature")
+	ErrExpired   = errors.New("token: expired")
+
+	encoding = base64.RawURLEncoding
+)
+
+// Claims what a token vouches for.
+type Claims struct {
+	UserID   uint32
+	Device   string
+	IssuedAt time.Time
+	Expire   time.Time
+}
+
+func sign(key, payload []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(payload)
+	return h.Sum(nil)
+}
+
+// Sign c with key.
+func Sign(key []byte, c *Claims) string {
+	payload := make([]byte, payloadLen, payloadLen+len(c.Device))
+	binary.BigEndian.PutUint32(payload[0:], c.UserID)
+	binary.BigEndian.PutUint64(payload[4:], uint64(c.IssuedAt.Unix()))
+	binary.BigEndian.PutUint64(payload[12:], uint64(c.Expire.Unix()))
+	payload = append(payload, c.Device...)
+	return encoding.EncodeToString(payload) + "." + encoding.EncodeToString(sign(key, payload))
+}
+
+// Verify checks the signature of token with key and that it has not
+// expired at now.
+func Verify(key []byte, token string, now time.Time) (*Claims, error) {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return nil, ErrToken
+	}
+	payload, err := encoding.DecodeString(token[:i])
+	if err != nil || len(payload) < payloadLen {
+		return nil, ErrToken
+	}
+	mac, err := encoding.DecodeString(token[i+1:])
+	if err != nil {
+		return nil, ErrToken
+	}
+	if !hmac.Equal(mac, sign(key, payload)) {
+		return nil, ErrSignature
+	}
+	c := &Claims{
+		UserID:   binary.BigEndian.Uint32(payload[0:]),
+		IssuedAt: time.Unix(int64(binary.BigEndian.Uint64(payload[4:])), 0),
+		Expire:   time.Unix(int64(binary.BigEndian.Uint64(payload[12:])), 0),
+		Device:   string(payload[payloadLen:]),
+	}
+	if !now.Before(c.Expire) {
+		return c, ErrExpired
+	}
+	return c, nil
+}
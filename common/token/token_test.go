@@ -0,0 +1,68 @@
+package token
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testKey   = []byte("test key")
+	testNow   = time.Unix(1500000000, 0)
+	testClaim = &Claims{
+		UserID:   11,
+		Device:   "android",
+		IssuedAt: testNow,
+		Expire:   testNow.Add(time.Hour),
+	}
+)
+
+// flip changes the i-th character of s to another base64url one.
+func flip(s string, i int) string {
+	c := byte('A')
+	if s[i] == c {
+		c = 'B'
+	}
+	return s[:i] + string(c) + s[i+1:]
+}
+
+func TestVerify(t *testing.T) {
+	token := Sign(testKey, testClaim)
+	dot := strings.IndexByte(token, '.')
+	short := encoding.EncodeToString(make([]byte, payloadLen-1))
+	tests := []struct {
+		name  string
+		key   []byte
+		token string
+		now   time.Time
+		want  error
+	}{
+		{"round trip", testKey, token, testNow, nil},
+		{"just before expire", testKey, token, testClaim.Expire.Add(-time.Nanosecond), nil},
+		{"at expire", testKey, token, testClaim.Expire, ErrExpired},
+		{"after expire", testKey, token, testClaim.Expire.Add(time.Second), ErrExpired},
+		{"wrong key", []byte("other key"), token, testNow, ErrSignature},
+		{"tampered payload", testKey, flip(token, 2), testNow, ErrSignature},
+		{"tampered mac", testKey, flip(token, dot+2), testNow, ErrSignature},
+		{"no dot", testKey, strings.Replace(token, ".", "", 1), testNow, ErrToken},
+		{"empty", testKey, "", testNow, ErrToken},
+		{"short payload", testKey, short + "." + encoding.EncodeToString(sign(testKey, make([]byte, payloadLen-1))), testNow, ErrToken},
+		{"bad payload base64", testKey, "!" + token[1:], testNow, ErrToken},
+		{"bad mac base64", testKey, token[:dot+1] + "!" + token[dot+2:], testNow, ErrToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := Verify(tt.key, tt.token, tt.now)
+			if err != tt.want {
+				t.Fatalf("Verify() error(%v), want %v", err, tt.want)
+			}
+			if err != nil && err != ErrExpired {
+				return
+			}
+			if c.UserID != testClaim.UserID || c.Device != testClaim.Device ||
+				!c.IssuedAt.Equal(testClaim.IssuedAt) || !c.Expire.Equal(testClaim.Expire) {
+				t.Errorf("Verify() = %+v, want %+v", c, testClaim)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package proto
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// Ver selects the body codec of a packet, a client picks one Ver for its
+// connection and the server replies with the same Ver.
+const (
+	VerJSON     = int16(1)
+	VerProtobuf = int16(2)
+	VerMsgpack  = int16(3)
+)
+
+var (
+	ErrBodyType = errors.New("proto: body type not supported by codec")
+)
+
+// BodyCodec serializes Proto.Body.
+type BodyCodec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	bodyCodecsLock sync.RWMutex
+	bodyCodecs     = map[int16]BodyCodec{
+		VerJSON:     JSONCodec{},
+		VerProtobuf: ProtobufCodec{},
+		VerMsgpack:  MsgpackCodec{},
+	}
+)
+
+// RegisterBodyCodec binds c to ver, replacing the codec already there.
+func RegisterBodyCodec(ver int16, c BodyCodec) {
+	bodyCodecsLock.Lock()
+	bodyCodecs[ver] = c
+	bodyCodecsLock.Unlock()
+}
+
+// BodyCodecOf returns the codec bound to ver, json for unknown vers.
+func BodyCodecOf(ver int16) BodyCodec {
+	bodyCodecsLock.RLock()
+	c, ok := bodyCodecs[ver]
+	bodyCodecsLock.RUnlock()
+	if !ok {
+		return JSONCodec{}
+	}
+	return c
+}
+
+// SetBody marshals v into the body with the codec of p.Ver.
+func (p *Proto) SetBody(v interface{}) (err error) {
+	p.Release()
+	p.Body, err = BodyCodecOf(p.Ver).Marshal(v)
+	return
+}
+
+// BindBody unmarshals the body into v with the codec of p.Ver.
+func (p *Proto) BindBody(v interface{}) error {
+	if len(p.Body) == 0 {
+		return nil
+	}
+	return BodyCodecOf(p.Ver).Unmarshal(p.Body, v)
+}
+
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// ProtobufCodec works with gogo generated messages and the hand written
+// ones in msg.go, see msg.proto.
+type ProtobufCodec struct{}
+
+type pbMarshaler interface {
+	Marshal() ([]byte, error)
+}
+
+type pbUnmarshaler interface {
+	Unmarshal(data []byte) error
+}
+
+func (ProtobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(pbMarshaler)
+	if !ok {
+		return nil, ErrBodyType
+	}
+	return m.Marshal()
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(pbUnmarshaler)
+	if !ok {
+		return ErrBodyType
+	}
+	return m.Unmarshal(data)
+}
+
+// MsgpackCodec falls back to the json tags so bodies keep their json keys.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := msgpack.NewEncoder(&buf).UseJSONTag(true).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.NewDecoder(bytes.NewReader(data)).UseJSONTag(true).Decode(v)
+}
@@ -0,0 +1,277 @@
+package proto
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	ErrPackLen   = errors.New("proto: invalid packet length")
+	ErrHeaderLen = errors.New("proto: invalid header length")
+	ErrVer       = errors.New("proto: ver 16 is reserved in the raw header layout")
+)
+
+func validHeaderLen(n int16) bool {
+	return n == RawHeaderLen || n == GoimHeaderLen
+}
+
+// putHeader writes the header of a packLen packet into b in the headerLen layout.
+func putHeader(b []byte, headerLen int16, packLen int, ver int16, p *Proto) {
+	binary.BigEndian.PutUint32(b[0:], uint32(packLen))
+	off := 4
+	if headerLen == GoimHeaderLen {
+		binary.BigEndian.PutUint16(b[4:], uint16(GoimHeaderLen))
+		off = 6
+	}
+	binary.BigEndian.PutUint16(b[off:], uint16(ver))
+	binary.BigEndian.PutUint32(b[off+2:], uint32(p.Cmd))
+	binary.BigEndian.PutUint32(b[off+6:], uint32(p.SeqId))
+}
+
+type flusher interface {
+	Flush() error
+}
+
+// Decoder reads protos from a stream. Unless SetHeaderLen pins it, the
+// header layout (RawHeaderLen or GoimHeaderLen) is detected on the first
+// packet and kept for the rest of the stream: in the goim layout the int16
+// after packLen is always 16, in ours it is the ver, so ver 16 is reserved.
+type Decoder struct {
+	rd         io.Reader
+	maxPackLen int32
+	headerLen  int16 // 0 until detected
+	compress   int16 // last compression seen
+	cipher     *streamCipher
+	hdr        [GoimHeaderLen]byte
+	zbuf       []byte
+}
+
+func NewDecoder(rd io.Reader) *Decoder {
+	return &Decoder{rd: rd, maxPackLen: DefaultMaxPackLen}
+}
+
+// SetMaxPackLen packets longer than n are rejected with ErrPackLen.
+func (d *Decoder) SetMaxPackLen(n int32) {
+	if n < int32(GoimHeaderLen) {
+		n = int32(GoimHeaderLen)
+	}
+	d.maxPackLen = n
+}
+
+// SetHeaderLen pins the header layout, 0 turns detection back on.
+func (d *Decoder) SetHeaderLen(n int16) error {
+	if n != 0 && !validHeaderLen(n) {
+		return ErrHeaderLen
+	}
+	d.headerLen = n
+	return nil
+}
+
+// HeaderLen is the layout in use, 0 before the first packet in detect mode.
+func (d *Decoder) HeaderLen() int16 {
+	return d.headerLen
+}
+
+// SetCipher opens every packet from now on, numbered from 0. dir is the
+// direction read, FromClient on a server. nil turns it off.
+func (d *Decoder) SetCipher(aead cipher.AEAD, dir byte) {
+	d.cipher = newStreamCipher(aead, dir)
+}
+
+// Compress is the compression of the last compressed packet read, a server
+// can answer compressed with enc.SetCompress(dec.Compress(), threshold).
+func (d *Decoder) Compress() int16 {
+	return d.compress
+}
+
+// Decode reads one packet into p, the body is nil when empty.
+// The body lives in a pooled buffer owned by p: it is only valid until the
+// next Decode into p or p.Release, copy it if it has to outlive them.
+func (d *Decoder) Decode(p *Proto) (err error) {
+	// packLen and the int16 after it are common to both layouts.
+	if _, err = io.ReadFull(d.rd, d.hdr[:6]); err != nil {
+		return
+	}
+	packLen := int32(binary.BigEndian.Uint32(d.hdr[0:]))
+	field := int16(binary.BigEndian.Uint16(d.hdr[4:]))
+	headerLen := d.headerLen
+	if headerLen == 0 {
+		if headerLen = RawHeaderLen; field == GoimHeaderLen {
+			headerLen = GoimHeaderLen
+		}
+	}
+	if headerLen == GoimHeaderLen && field != GoimHeaderLen {
+		return ErrHeaderLen
+	}
+	if packLen < int32(headerLen) || packLen > d.maxPackLen {
+		return ErrPackLen
+	}
+	d.headerLen = headerLen
+	if _, err = io.ReadFull(d.rd, d.hdr[6:headerLen]); err != nil {
+		return
+	}
+	off := 4
+	if headerLen == GoimHeaderLen {
+		off = 6
+	}
+	p.Ver = int16(binary.BigEndian.Uint16(d.hdr[off:]))
+	p.Cmd = int32(binary.BigEndian.Uint32(d.hdr[off+2:]))
+	p.SeqId = int32(binary.BigEndian.Uint32(d.hdr[off+6:]))
+	bodyLen := int(packLen - int32(headerLen))
+	if bodyLen > 0 {
+		p.Body = p.body(bodyLen)
+		if _, err = io.ReadFull(d.rd, p.Body); err != nil {
+			return
+		}
+	} else {
+		p.Body = nil
+	}
+	if d.cipher != nil {
+		if p.Body, err = d.cipher.open(d.hdr[:headerLen], p.Body); err != nil {
+			return
+		}
+		if len(p.Body) == 0 {
+			p.Body = nil
+		}
+	}
+	if c := verCompress(p.Ver); c != CompressNone {
+		p.Ver = verWithCompress(p.Ver, CompressNone)
+		d.compress = c
+		err = d.decompress(p, c)
+	}
+	return
+}
+
+// Release drops the decompression buffer, the next compressed packet
+// allocates it again.
+func (d *Decoder) Release() {
+	d.zbuf = nil
+}
+
+func (d *Decoder) decompress(p *Proto, c int16) (err error) {
+	z, ok := compressorOf(c)
+	if !ok {
+		return ErrCompress
+	}
+	if d.zbuf, err = z.Decompress(d.zbuf[:0], p.Body, int(d.maxPackLen)); err != nil {
+		return
+	}
+	if len(d.zbuf) == 0 {
+		p.Body = nil
+		return
+	}
+	p.Body = p.body(len(d.zbuf))
+	copy(p.Body, d.zbuf)
+	return
+}
+
+// Encoder writes protos to a stream, buffered writers are flushed per packet.
+type Encoder struct {
+	wr         io.Writer
+	maxPackLen int32
+	headerLen  int16
+	compress   int16
+	threshold  int
+	cipher     *streamCipher
+	buf        *[]byte // pooled, header and body are written with one Write
+	zbuf       []byte
+}
+
+func NewEncoder(wr io.Writer) *Encoder {
+	return &Encoder{wr: wr, maxPackLen: DefaultMaxPackLen, headerLen: RawHeaderLen}
+}
+
+// SetHeaderLen selects the header layout, RawHeaderLen by default.
+// A server replies in the peer's layout with enc.SetHeaderLen(dec.HeaderLen()).
+func (e *Encoder) SetHeaderLen(n int16) error {
+	if !validHeaderLen(n) {
+		return ErrHeaderLen
+	}
+	e.headerLen = n
+	return nil
+}
+
+// SetCipher seals every packet from now on, numbered from 0. dir is the
+// direction written, FromServer on a server. nil turns it off.
+func (e *Encoder) SetCipher(aead cipher.AEAD, dir byte) {
+	e.cipher = newStreamCipher(aead, dir)
+}
+
+// SetCompress compresses bodies of at least threshold bytes with the
+// compressor id, CompressNone turns it off. A body is sent as is when it
+// does not get shorter.
+func (e *Encoder) SetCompress(id int16, threshold int) error {
+	if id != CompressNone {
+		if _, ok := compressorOf(id); !ok {
+			return ErrCompress
+		}
+	}
+	e.compress = id
+	e.threshold = threshold
+	return nil
+}
+
+// SetMaxPackLen packets longer than n are refused with ErrPackLen.
+func (e *Encoder) SetMaxPackLen(n int32) {
+	if n < int32(GoimHeaderLen) {
+		n = int32(GoimHeaderLen)
+	}
+	e.maxPackLen = n
+}
+
+// Encode writes p, a packet the Decoder would take for the goim layout is
+// refused with ErrVer.
+func (e *Encoder) Encode(p *Proto) (err error) {
+	body, ver := []byte(p.Body), p.Ver
+	if e.compress != CompressNone && len(body) >= e.threshold {
+		z, _ := compressorOf(e.compress)
+		if e.zbuf, err = z.Compress(e.zbuf[:0], body); err != nil {
+			return
+		}
+		if len(e.zbuf) < len(body) {
+			body, ver = e.zbuf, verWithCompress(ver, e.compress)
+		}
+	}
+	if e.headerLen == RawHeaderLen && ver == GoimHeaderLen {
+		return ErrVer
+	}
+	packLen := int(e.headerLen) + len(body)
+	if e.cipher != nil {
+		packLen += e.cipher.aead.Overhead()
+	}
+	if packLen > int(e.maxPackLen) {
+		return ErrPackLen
+	}
+	if e.buf == nil || cap(*e.buf) < packLen {
+		if e.buf != nil {
+			putBuffer(e.buf)
+		}
+		e.buf = getBuffer(packLen)
+	}
+	b := (*e.buf)[:packLen]
+	putHeader(b, e.headerLen, packLen, ver, p)
+	if e.cipher != nil {
+		e.cipher.seal(b[e.headerLen:e.headerLen], b[:e.headerLen], body)
+	} else {
+		copy(b[e.headerLen:], body)
+	}
+	if _, err = e.wr.Write(b); err != nil {
+		return
+	}
+	if f, ok := e.wr.(flusher); ok {
+		err = f.Flush()
+	}
+	return
+}
+
+// Release gives the buffers back, a stream that goes idle holds none. The
+// next Encode takes them again.
+func (e *Encoder) Release() {
+	if e.buf != nil {
+		putBuffer(e.buf)
+		e.buf = nil
+	}
+	e.zbuf = nil
+}
@@ -0,0 +1,120 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// compares the codec with the old per field binary.Write/binary.Read codec
+// which imserver and imclient used to copy around.
+//
+//	go test -bench . -benchmem
+
+var benchBody = []byte(`{"msg_flag":"123","relation_type":2,"userId":11,"object_id":22}`)
+
+func BenchmarkEncode(b *testing.B) {
+	b.Run("binary.Write", func(b *testing.B) {
+		b.ReportAllocs()
+		wr := bufio.NewWriter(ioutil.Discard)
+		p := &Proto{Ver: VerJSON, Cmd: 1001, Body: benchBody}
+		for i := 0; i < b.N; i++ {
+			p.SeqId = int32(i)
+			if err := oldWriteProto(wr, p); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Encoder", func(b *testing.B) {
+		b.ReportAllocs()
+		enc := NewEncoder(bufio.NewWriter(ioutil.Discard))
+		p := &Proto{Ver: VerJSON, Cmd: 1001, Body: benchBody}
+		for i := 0; i < b.N; i++ {
+			p.SeqId = int32(i)
+			if err := enc.Encode(p); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDecode(b *testing.B) {
+	frame := new(bytes.Buffer)
+	NewEncoder(frame).Encode(&Proto{Ver: VerJSON, Cmd: 1001, SeqId: 1, Body: benchBody})
+
+	b.Run("binary.Read", func(b *testing.B) {
+		b.ReportAllocs()
+		r := bytes.NewReader(frame.Bytes())
+		rd := bufio.NewReader(r)
+		p := new(Proto)
+		for i := 0; i < b.N; i++ {
+			r.Reset(frame.Bytes())
+			rd.Reset(r)
+			if err := oldReadProto(rd, p); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Decoder", func(b *testing.B) {
+		b.ReportAllocs()
+		r := bytes.NewReader(frame.Bytes())
+		rd := bufio.NewReader(r)
+		dec := NewDecoder(rd)
+		p := new(Proto)
+		defer p.Release()
+		for i := 0; i < b.N; i++ {
+			r.Reset(frame.Bytes())
+			rd.Reset(r)
+			if err := dec.Decode(p); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func oldWriteProto(wr *bufio.Writer, p *Proto) (err error) {
+	if err = binary.Write(wr, binary.BigEndian, uint32(RawHeaderLen)+uint32(len(p.Body))); err != nil {
+		return
+	}
+	if err = binary.Write(wr, binary.BigEndian, p.Ver); err != nil {
+		return
+	}
+	if err = binary.Write(wr, binary.BigEndian, p.Cmd); err != nil {
+		return
+	}
+	if err = binary.Write(wr, binary.BigEndian, p.SeqId); err != nil {
+		return
+	}
+	if p.Body != nil {
+		if err = binary.Write(wr, binary.BigEndian, p.Body); err != nil {
+			return
+		}
+	}
+	return wr.Flush()
+}
+
+func oldReadProto(rd *bufio.Reader, p *Proto) (err error) {
+	var packLen int32
+	if err = binary.Read(rd, binary.BigEndian, &packLen); err != nil {
+		return
+	}
+	if err = binary.Read(rd, binary.BigEndian, &p.Ver); err != nil {
+		return
+	}
+	if err = binary.Read(rd, binary.BigEndian, &p.Cmd); err != nil {
+		return
+	}
+	if err = binary.Read(rd, binary.BigEndian, &p.SeqId); err != nil {
+		return
+	}
+	if bodyLen := int(packLen - int32(RawHeaderLen)); bodyLen > 0 {
+		p.Body = make([]byte, bodyLen)
+		_, err = io.ReadFull(rd, p.Body)
+	} else {
+		p.Body = nil
+	}
+	return
+}
@@ -0,0 +1,238 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func newTestCipher(t *testing.T) cipher.AEAD {
+	key, err := NewSessionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := NewSessionCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+// packet is a raw packet of headerLen with packLen in its header.
+func packet(headerLen int16, packLen int, ver int16, body []byte) []byte {
+	b := make([]byte, int(headerLen)+len(body))
+	putHeader(b, headerLen, packLen, ver, &Proto{Cmd: 1001, SeqId: 7})
+	copy(b[headerLen:], body)
+	return b
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	small := []byte(`{"userId":11}`)
+	big := bytes.Repeat([]byte(`{"msg_flag":"123","relation_type":2,"userId":11}`), 64)
+	tests := []struct {
+		name      string
+		headerLen int16
+		compress  int16
+		cipher    bool
+		ver       int16
+		body      []byte
+	}{
+		{"raw", RawHeaderLen, CompressNone, false, VerJSON, small},
+		{"raw empty body", RawHeaderLen, CompressNone, false, VerJSON, nil},
+		{"goim", GoimHeaderLen, CompressNone, false, VerJSON, small},
+		{"goim ver 16", GoimHeaderLen, CompressNone, false, GoimHeaderLen, small},
+		{"raw gzip", RawHeaderLen, CompressGzip, false, VerProtobuf, big},
+		{"goim flate", GoimHeaderLen, CompressFlate, false, VerMsgpack, big},
+		{"gzip under threshold", RawHeaderLen, CompressGzip, false, VerJSON, small},
+		{"raw cipher", RawHeaderLen, CompressNone, true, VerJSON, small},
+		{"goim cipher empty body", GoimHeaderLen, CompressNone, true, VerJSON, nil},
+		{"raw gzip cipher", RawHeaderLen, CompressGzip, true, VerJSON, big},
+		{"goim flate cipher", GoimHeaderLen, CompressFlate, true, VerJSON, big},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stream bytes.Buffer
+			enc, dec := NewEncoder(&stream), NewDecoder(&stream)
+			if err := enc.SetHeaderLen(tt.headerLen); err != nil {
+				t.Fatal(err)
+			}
+			if err := enc.SetCompress(tt.compress, DefaultCompressThreshold); err != nil {
+				t.Fatal(err)
+			}
+			if tt.cipher {
+				aead := newTestCipher(t)
+				enc.SetCipher(aead, FromServer)
+				dec.SetCipher(aead, FromServer)
+			}
+			// the layout detected on the first packet holds for the next.
+			for seq := int32(1); seq <= 2; seq++ {
+				if err := enc.Encode(&Proto{Ver: tt.ver, Cmd: 1001, SeqId: seq, Body: tt.body}); err != nil {
+					t.Fatalf("Encode() error(%v)", err)
+				}
+			}
+			packLen := int(binary.BigEndian.Uint32(stream.Bytes()))
+			compressed := tt.compress != CompressNone && len(tt.body) >= DefaultCompressThreshold
+			if compressed && packLen >= int(tt.headerLen)+len(tt.body) {
+				t.Errorf("packLen %d, body of %d not compressed", packLen, len(tt.body))
+			}
+			p := new(Proto)
+			defer p.Release()
+			for seq := int32(1); seq <= 2; seq++ {
+				if err := dec.Decode(p); err != nil {
+					t.Fatalf("Decode() error(%v)", err)
+				}
+				if p.Ver != tt.ver || p.Cmd != 1001 || p.SeqId != seq {
+					t.Errorf("got ver %d cmd %d seq %d, want %d 1001 %d", p.Ver, p.Cmd, p.SeqId, tt.ver, seq)
+				}
+				if !bytes.Equal(p.Body, tt.body) {
+					t.Errorf("got body %q, want %q", p.Body, tt.body)
+				}
+			}
+			if n := dec.HeaderLen(); n != tt.headerLen {
+				t.Errorf("HeaderLen() = %d, want %d", n, tt.headerLen)
+			}
+			if c := dec.Compress(); compressed && c != tt.compress {
+				t.Errorf("Compress() = %d, want %d", c, tt.compress)
+			}
+			if stream.Len() != 0 {
+				t.Errorf("%d bytes left", stream.Len())
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	body := []byte(`{"userId":11}`)
+	raw := packet(RawHeaderLen, int(RawHeaderLen)+len(body), VerJSON, body)
+	tests := []struct {
+		name      string
+		data      []byte
+		headerLen int16 // pinned, 0 detects
+		want      error
+	}{
+		{"empty", nil, 0, io.EOF},
+		{"truncated header", raw[:5], 0, io.ErrUnexpectedEOF},
+		{"truncated raw header", raw[:10], 0, io.ErrUnexpectedEOF},
+		{"truncated goim header", packet(GoimHeaderLen, int(GoimHeaderLen), VerJSON, nil)[:12], 0, io.ErrUnexpectedEOF},
+		{"truncated body", raw[:len(raw)-1], 0, io.ErrUnexpectedEOF},
+		{"packLen under header", packet(RawHeaderLen, int(RawHeaderLen)-1, VerJSON, nil), 0, ErrPackLen},
+		{"packLen over max", packet(RawHeaderLen, int(DefaultMaxPackLen)+1, VerJSON, nil), 0, ErrPackLen},
+		{"goim pinned, raw packet", raw, GoimHeaderLen, ErrHeaderLen},
+		{"unknown compression", packet(RawHeaderLen, int(RawHeaderLen)+len(body), verWithCompress(VerJSON, 9), body), 0, ErrCompress},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dec := NewDecoder(bytes.NewReader(tt.data))
+			if err := dec.SetHeaderLen(tt.headerLen); err != nil {
+				t.Fatal(err)
+			}
+			p := new(Proto)
+			defer p.Release()
+			if err := dec.Decode(p); err != tt.want {
+				t.Errorf("Decode() error(%v), want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCipherErrors(t *testing.T) {
+	aead := newTestCipher(t)
+	var stream bytes.Buffer
+	enc := NewEncoder(&stream)
+	enc.SetCipher(aead, FromServer)
+	for seq := int32(1); seq <= 2; seq++ {
+		if err := enc.Encode(&Proto{Ver: VerJSON, Cmd: 1001, SeqId: seq, Body: []byte(`{"userId":11}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	two := stream.Bytes()
+	first := two[:len(two)/2]
+	tampered := func(i int) []byte {
+		b := append([]byte(nil), first...)
+		b[i] ^= 1
+		return b
+	}
+	tests := []struct {
+		name string
+		data []byte
+		aead cipher.AEAD
+		dir  byte
+		want error // nil for any error
+	}{
+		{"other key", first, newTestCipher(t), FromServer, nil},
+		{"other direction", first, aead, FromClient, nil},
+		{"tampered cmd", tampered(9), aead, FromServer, nil},
+		{"tampered seq", tampered(13), aead, FromServer, nil},
+		{"tampered body", tampered(len(first) - 1), aead, FromServer, nil},
+		{"replayed", append(append([]byte(nil), first...), first...), aead, FromServer, nil},
+		{"reordered", append(append([]byte(nil), two[len(first):]...), first...), aead, FromServer, nil},
+		{"too short", packet(RawHeaderLen, int(RawHeaderLen)+4, VerJSON, []byte("abcd")), aead, FromServer, ErrCipherLen},
+		{"plaintext empty body", packet(RawHeaderLen, int(RawHeaderLen), VerJSON, nil), aead, FromServer, ErrCipherLen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dec := NewDecoder(bytes.NewReader(tt.data))
+			dec.SetCipher(tt.aead, tt.dir)
+			p := new(Proto)
+			defer p.Release()
+			var err error
+			for err == nil {
+				err = dec.Decode(p)
+			}
+			if err == io.EOF || (tt.want != nil && err != tt.want) {
+				t.Errorf("Decode() error(%v), want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeDecompressLimit(t *testing.T) {
+	var stream bytes.Buffer
+	enc := NewEncoder(&stream)
+	enc.SetCompress(CompressGzip, 0)
+	enc.SetMaxPackLen(1 << 20)
+	// compresses far below the limit, inflates far above it.
+	if err := enc.Encode(&Proto{Ver: VerJSON, Cmd: 1001, Body: make([]byte, 1<<18)}); err != nil {
+		t.Fatal(err)
+	}
+	p := new(Proto)
+	defer p.Release()
+	if err := NewDecoder(&stream).Decode(p); err != ErrPackLen {
+		t.Errorf("Decode() error(%v), want %v", err, ErrPackLen)
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		headerLen int16
+		p         *Proto
+		want      error
+	}{
+		{"body over max", RawHeaderLen, &Proto{Ver: VerJSON, Body: make([]byte, DefaultMaxPackLen)}, ErrPackLen},
+		{"raw ver 16", RawHeaderLen, &Proto{Ver: GoimHeaderLen}, ErrVer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stream bytes.Buffer
+			enc := NewEncoder(&stream)
+			if err := enc.SetHeaderLen(tt.headerLen); err != nil {
+				t.Fatal(err)
+			}
+			if err := enc.Encode(tt.p); err != tt.want {
+				t.Errorf("Encode() error(%v), want %v", err, tt.want)
+			}
+			if stream.Len() != 0 {
+				t.Errorf("%d bytes written", stream.Len())
+			}
+		})
+	}
+	if err := NewEncoder(nil).SetHeaderLen(15); err != ErrHeaderLen {
+		t.Errorf("SetHeaderLen(15) error(%v), want %v", err, ErrHeaderLen)
+	}
+	if err := NewEncoder(nil).SetCompress(9, 0); err != ErrCompress {
+		t.Errorf("SetCompress(9) error(%v), want %v", err, ErrCompress)
+	}
+}
@@ -0,0 +1,163 @@
+package proto
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Ver bits 8-11 carry the body compression of a packet, the low byte stays
+// the body codec. The Decoder strips the bits so handlers see the plain Ver.
+const (
+	CompressNone  = int16(0)
+	CompressGzip  = int16(1)
+	CompressFlate = int16(2)
+
+	verCompressShift = 8
+	verCompressMask  = int16(0xf << verCompressShift)
+	maxCompress      = int16(0xf)
+
+	// DefaultCompressThreshold bodies shorter than it are sent as is.
+	DefaultCompressThreshold = 512
+)
+
+var (
+	ErrCompress = errors.New("proto: unknown body compression")
+)
+
+// Compressor compresses Proto.Body.
+type Compressor interface {
+	Name() string
+	// Compress appends the compressed src to dst.
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress appends the decompressed src to dst, at most limit bytes.
+	Decompress(dst, src []byte, limit int) ([]byte, error)
+}
+
+var (
+	compressorsLock sync.RWMutex
+	compressors     = map[int16]Compressor{
+		CompressGzip:  gzipCompressor{},
+		CompressFlate: flateCompressor{},
+	}
+)
+
+// RegisterCompressor binds c to id, 1 <= id <= 15.
+func RegisterCompressor(id int16, c Compressor) error {
+	if id <= CompressNone || id > maxCompress {
+		return ErrCompress
+	}
+	compressorsLock.Lock()
+	compressors[id] = c
+	compressorsLock.Unlock()
+	return nil
+}
+
+func compressorOf(id int16) (c Compressor, ok bool) {
+	compressorsLock.RLock()
+	c, ok = compressors[id]
+	compressorsLock.RUnlock()
+	return
+}
+
+func verCompress(ver int16) int16 {
+	return (ver & verCompressMask) >> verCompressShift
+}
+
+func verWithCompress(ver, id int16) int16 {
+	return ver&^verCompressMask | id<<verCompressShift
+}
+
+// appendBuffer lets the stdlib writers append to a caller's slice.
+type appendBuffer struct {
+	b []byte
+}
+
+func (a *appendBuffer) Write(p []byte) (int, error) {
+	a.b = append(a.b, p...)
+	return len(p), nil
+}
+
+// readLimited appends r to dst, failing with ErrPackLen past limit bytes.
+func readLimited(dst []byte, r io.Reader, limit int) ([]byte, error) {
+	buf := &appendBuffer{b: dst}
+	n, err := io.Copy(buf, io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return dst, err
+	}
+	if n > int64(limit) {
+		return dst, ErrPackLen
+	}
+	return buf.b, nil
+}
+
+var (
+	flateWriters sync.Pool
+	gzipWriters  sync.Pool
+)
+
+type flateCompressor struct{}
+
+func (flateCompressor) Name() string {
+	return "flate"
+}
+
+func (flateCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := &appendBuffer{b: dst}
+	w, _ := flateWriters.Get().(*flate.Writer)
+	if w == nil {
+		w, _ = flate.NewWriter(buf, flate.DefaultCompression)
+	} else {
+		w.Reset(buf)
+	}
+	defer flateWriters.Put(w)
+	if _, err := w.Write(src); err != nil {
+		return dst, err
+	}
+	if err := w.Close(); err != nil {
+		return dst, err
+	}
+	return buf.b, nil
+}
+
+func (flateCompressor) Decompress(dst, src []byte, limit int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return readLimited(dst, r, limit)
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (gzipCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := &appendBuffer{b: dst}
+	w, _ := gzipWriters.Get().(*gzip.Writer)
+	if w == nil {
+		w = gzip.NewWriter(buf)
+	} else {
+		w.Reset(buf)
+	}
+	defer gzipWriters.Put(w)
+	if _, err := w.Write(src); err != nil {
+		return dst, err
+	}
+	if err := w.Close(); err != nil {
+		return dst, err
+	}
+	return buf.b, nil
+}
+
+func (gzipCompressor) Decompress(dst, src []byte, limit int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return dst, err
+	}
+	defer r.Close()
+	return readLimited(dst, r, limit)
+}
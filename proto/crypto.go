@@ -0,0 +1,148 @@
+package proto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+)
+
+// The OP_HANDSHARE body is a random AES-256 session key encrypted with the
+// server's RSA public key (OAEP, SHA-256). Once the server has it, every
+// body in both directions, empty ones too, is AES-GCM sealed with the
+// packet header as additional data, starting with the OP_HANDSHARE_REPLY.
+// The nonce is not sent: it is the direction and the number of the packet
+// in its direction, so a replayed, dropped or reordered packet does not open.
+const (
+	SessionKeyLen = 32
+)
+
+// Directions of a packet, for Encoder/Decoder.SetCipher.
+const (
+	FromClient byte = 1
+	FromServer byte = 2
+)
+
+var (
+	ErrPemKey    = errors.New("proto: no rsa key in pem file")
+	ErrCipherLen = errors.New("proto: cipher body too short")
+)
+
+// NewSessionKey returns a random session key for the handshake.
+func NewSessionKey() ([]byte, error) {
+	key := make([]byte, SessionKeyLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func EncryptSessionKey(pub *rsa.PublicKey, key []byte) ([]byte, error) {
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+}
+
+func DecryptSessionKey(pri *rsa.PrivateKey, cipherKey []byte) ([]byte, error) {
+	return rsa.DecryptOAEP(sha256.New(), rand.Reader, pri, cipherKey, nil)
+}
+
+// NewSessionCipher returns the AES-GCM cipher for Encoder/Decoder.SetCipher.
+func NewSessionCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// LoadRSAPublicKey reads a PKIX or PKCS#1 pem public key.
+func LoadRSAPublicKey(file string) (*rsa.PublicKey, error) {
+	b, err := readPem(file)
+	if err != nil {
+		return nil, err
+	}
+	if pub, err := x509.ParsePKCS1PublicKey(b); err == nil {
+		return pub, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(b)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, ErrPemKey
+	}
+	return pub, nil
+}
+
+// LoadRSAPrivateKey reads a PKCS#1 or PKCS#8 pem private key.
+func LoadRSAPrivateKey(file string) (*rsa.PrivateKey, error) {
+	b, err := readPem(file)
+	if err != nil {
+		return nil, err
+	}
+	if pri, err := x509.ParsePKCS1PrivateKey(b); err == nil {
+		return pri, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(b)
+	if err != nil {
+		return nil, err
+	}
+	pri, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, ErrPemKey
+	}
+	return pri, nil
+}
+
+func readPem(file string) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrPemKey
+	}
+	return block.Bytes, nil
+}
+
+// streamCipher seals or opens the packets of one direction in order.
+type streamCipher struct {
+	aead  cipher.AEAD
+	nonce []byte // direction, zeros, big endian packet number
+	seq   uint64
+}
+
+func newStreamCipher(aead cipher.AEAD, dir byte) *streamCipher {
+	if aead == nil {
+		return nil
+	}
+	c := &streamCipher{aead: aead, nonce: make([]byte, aead.NonceSize())}
+	c.nonce[0] = dir
+	return c
+}
+
+func (c *streamCipher) next() []byte {
+	binary.BigEndian.PutUint64(c.nonce[len(c.nonce)-8:], c.seq)
+	c.seq++
+	return c.nonce
+}
+
+// seal appends src sealed with header to dst.
+func (c *streamCipher) seal(dst, header, src []byte) []byte {
+	return c.aead.Seal(dst, c.next(), src, header)
+}
+
+// open decrypts src sealed with header in place.
+func (c *streamCipher) open(header, src []byte) ([]byte, error) {
+	if len(src) < c.aead.Overhead() {
+		return nil, ErrCipherLen
+	}
+	return c.aead.Open(src[:0], c.next(), src, header)
+}
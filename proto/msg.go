@@ -0,0 +1,289 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrPbMessage = errors.New("proto: malformed protobuf body")
+)
+
+// ReqNoticeFriend body of a friend notice request, and of its push.
+// MsgID is set by imserver on pushes the client has to ack, MsgFlag is the
+// sender's id of the notice, clients drop pushes whose sender and MsgFlag
+// they saw.
+type ReqNoticeFriend struct {
+	MsgFlag      string `json:"msg_flag"`
+	RelationType uint32 `json:"relation_type"`
+	UserID       uint32 `json:"userId"`
+	ObjectID     uint32 `json:"object_id"`
+	MsgID        uint64 `json:"msg_id"`
+}
+
+func (m *ReqNoticeFriend) Marshal() ([]byte, error) {
+	var b []byte
+	b = pbAppendString(b, 1, m.MsgFlag)
+	b = pbAppendVarint(b, 2, uint64(m.RelationType))
+	b = pbAppendVarint(b, 3, uint64(m.UserID))
+	b = pbAppendVarint(b, 4, uint64(m.ObjectID))
+	b = pbAppendVarint(b, 5, m.MsgID)
+	return b, nil
+}
+
+func (m *ReqNoticeFriend) Unmarshal(data []byte) error {
+	*m = ReqNoticeFriend{}
+	return pbRange(data, func(field int, v uint64, s []byte) {
+		switch field {
+		case 1:
+			m.MsgFlag = string(s)
+		case 2:
+			m.RelationType = uint32(v)
+		case 3:
+			m.UserID = uint32(v)
+		case 4:
+			m.ObjectID = uint32(v)
+		case 5:
+			m.MsgID = v
+		}
+	})
+}
+
+// ReqAuth body of OP_AUTH.
+type ReqAuth struct {
+	UserID uint32 `json:"userId"`
+	Device string `json:"device"`
+	Token  string `json:"token"`
+}
+
+// String keeps the token out of the logs.
+func (m *ReqAuth) String() string {
+	return fmt.Sprintf("{UserID:%d Device:%s Token:%d bytes}", m.UserID, m.Device, len(m.Token))
+}
+
+func (m *ReqAuth) Marshal() ([]byte, error) {
+	var b []byte
+	b = pbAppendVarint(b, 1, uint64(m.UserID))
+	b = pbAppendString(b, 2, m.Device)
+	b = pbAppendString(b, 3, m.Token)
+	return b, nil
+}
+
+func (m *ReqAuth) Unmarshal(data []byte) error {
+	*m = ReqAuth{}
+	return pbRange(data, func(field int, v uint64, s []byte) {
+		switch field {
+		case 1:
+			m.UserID = uint32(v)
+		case 2:
+			m.Device = string(s)
+		case 3:
+			m.Token = string(s)
+		}
+	})
+}
+
+// ReqNoticeGroup body of a group (or group role) notice request and of its
+// push, Role is the member role the notice is for, 0 for every member.
+// MsgID and MsgFlag are as in ReqNoticeFriend.
+type ReqNoticeGroup struct {
+	MsgFlag string `json:"msg_flag"`
+	UserID  uint32 `json:"userId"`
+	GroupID uint32 `json:"group_id"`
+	Role    uint32 `json:"role"`
+	Content string `json:"content"`
+	MsgID   uint64 `json:"msg_id"`
+}
+
+func (m *ReqNoticeGroup) Marshal() ([]byte, error) {
+	var b []byte
+	b = pbAppendString(b, 1, m.MsgFlag)
+	b = pbAppendVarint(b, 2, uint64(m.UserID))
+	b = pbAppendVarint(b, 3, uint64(m.GroupID))
+	b = pbAppendVarint(b, 4, uint64(m.Role))
+	b = pbAppendString(b, 5, m.Content)
+	b = pbAppendVarint(b, 6, m.MsgID)
+	return b, nil
+}
+
+func (m *ReqNoticeGroup) Unmarshal(data []byte) error {
+	*m = ReqNoticeGroup{}
+	return pbRange(data, func(field int, v uint64, s []byte) {
+		switch field {
+		case 1:
+			m.MsgFlag = string(s)
+		case 2:
+			m.UserID = uint32(v)
+		case 3:
+			m.GroupID = uint32(v)
+		case 4:
+			m.Role = uint32(v)
+		case 5:
+			m.Content = string(s)
+		case 6:
+			m.MsgID = v
+		}
+	})
+}
+
+// ReqPushAck body of a push ack, the push MsgID is received. imserver
+// sends a push again until it is acked, clients drop the copies.
+type ReqPushAck struct {
+	MsgID uint64 `json:"msg_id"`
+}
+
+func (m *ReqPushAck) Marshal() ([]byte, error) {
+	return pbAppendVarint(nil, 1, m.MsgID), nil
+}
+
+func (m *ReqPushAck) Unmarshal(data []byte) error {
+	*m = ReqPushAck{}
+	return pbRange(data, func(field int, v uint64, s []byte) {
+		if field == 1 {
+			m.MsgID = v
+		}
+	})
+}
+
+// Group member roles, a lower value ranks higher.
+const (
+	GROUP_ROLE_OWNER  = uint32(1)
+	GROUP_ROLE_ADMIN  = uint32(2)
+	GROUP_ROLE_MEMBER = uint32(3)
+)
+
+// ReqGroup body of the group membership requests: create, join, quit and
+// set role. MemberID and Role are only read by set role, Role 0 removes
+// MemberID from the group.
+type ReqGroup struct {
+	GroupID  uint32 `json:"group_id"`
+	MemberID uint32 `json:"member_id"`
+	Role     uint32 `json:"role"`
+}
+
+func (m *ReqGroup) Marshal() ([]byte, error) {
+	var b []byte
+	b = pbAppendVarint(b, 1, uint64(m.GroupID))
+	b = pbAppendVarint(b, 2, uint64(m.MemberID))
+	b = pbAppendVarint(b, 3, uint64(m.Role))
+	return b, nil
+}
+
+func (m *ReqGroup) Unmarshal(data []byte) error {
+	*m = ReqGroup{}
+	return pbRange(data, func(field int, v uint64, s []byte) {
+		switch field {
+		case 1:
+			m.GroupID = uint32(v)
+		case 2:
+			m.MemberID = uint32(v)
+		case 3:
+			m.Role = uint32(v)
+		}
+	})
+}
+
+// AckNotice.Code values.
+const (
+	CODE_OK          = 0
+	CODE_FAILED      = 1 // the handler failed, Info tells why
+	CODE_UNKNOWN_CMD = 2
+	CODE_BAD_BODY    = 3
+	CODE_DENIED      = 4 // the user's role does not allow it
+	CODE_NOT_AUTHED  = 5 // OP_AUTH first, or its credentials were refused
+)
+
+// AckNotice body of every notice ack, Code 0 is ok.
+type AckNotice struct {
+	Code    int    `json:"code"`
+	Info    string `json:"info"`
+	MsgFlag string `json:"msg_flag"`
+}
+
+func (m *AckNotice) Marshal() ([]byte, error) {
+	var b []byte
+	b = pbAppendVarint(b, 1, uint64(int64(m.Code)))
+	b = pbAppendString(b, 2, m.Info)
+	b = pbAppendString(b, 3, m.MsgFlag)
+	return b, nil
+}
+
+func (m *AckNotice) Unmarshal(data []byte) error {
+	*m = AckNotice{}
+	return pbRange(data, func(field int, v uint64, s []byte) {
+		switch field {
+		case 1:
+			m.Code = int(int64(v))
+		case 2:
+			m.Info = string(s)
+		case 3:
+			m.MsgFlag = string(s)
+		}
+	})
+}
+
+// protobuf wire helpers, only varint and length delimited fields are used.
+const (
+	pbWireVarint = 0
+	pbWireBytes  = 2
+)
+
+func pbAppendVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|pbWireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func pbAppendString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|pbWireBytes)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// pbRange calls fn for every varint or length delimited field of data,
+// s is only set for the latter. Fixed width fields are skipped.
+func pbRange(data []byte, fn func(field int, v uint64, s []byte)) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return ErrPbMessage
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case pbWireVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return ErrPbMessage
+			}
+			data = data[n:]
+			fn(field, v, nil)
+		case pbWireBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return ErrPbMessage
+			}
+			fn(field, 0, data[n:n+int(l)])
+			data = data[n+int(l):]
+		case 1: // fixed64
+			if len(data) < 8 {
+				return ErrPbMessage
+			}
+			data = data[8:]
+		case 5: // fixed32
+			if len(data) < 4 {
+				return ErrPbMessage
+			}
+			data = data[4:]
+		default:
+			return ErrPbMessage
+		}
+	}
+	return nil
+}
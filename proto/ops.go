@@ -0,0 +1,17 @@
+package proto
+
+// operations shared by every client and server, business cmds live with
+// the programs using them.
+const (
+	OP_HANDSHARE        = int32(0)
+	OP_HANDSHARE_REPLY  = int32(1)
+	OP_HEARTBEAT        = int32(2)
+	OP_HEARTBEAT_REPLY  = int32(3)
+	OP_SEND_SMS         = int32(4)
+	OP_SEND_SMS_REPLY   = int32(5)
+	OP_DISCONNECT_REPLY = int32(6)
+	OP_AUTH             = int32(7)
+	OP_AUTH_REPLY       = int32(8)
+	OP_TEST             = int32(254)
+	OP_TEST_REPLY       = int32(255)
+)
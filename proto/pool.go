@@ -0,0 +1,50 @@
+package proto
+
+import (
+	"sync"
+)
+
+const (
+	minBufShift = 6  // 64B
+	maxBufShift = 16 // 64KB, bigger bodies are not pooled
+)
+
+// body buffers are pooled by power of two size classes, the pools hold
+// *[]byte so that putting a buffer back does not allocate.
+var bufPools [maxBufShift - minBufShift + 1]sync.Pool
+
+func init() {
+	for i := range bufPools {
+		size := 1 << uint(i+minBufShift)
+		bufPools[i].New = func() interface{} {
+			b := make([]byte, size)
+			return &b
+		}
+	}
+}
+
+func bufClass(n int) int {
+	for i := 0; i < len(bufPools); i++ {
+		if n <= 1<<uint(i+minBufShift) {
+			return i
+		}
+	}
+	return -1
+}
+
+func getBuffer(n int) *[]byte {
+	if i := bufClass(n); i >= 0 {
+		return bufPools[i].Get().(*[]byte)
+	}
+	b := make([]byte, n)
+	return &b
+}
+
+func putBuffer(b *[]byte) {
+	c := cap(*b)
+	// only exact size classes go back, anything else is left to the gc.
+	if i := bufClass(c); i >= 0 && c == 1<<uint(i+minBufShift) {
+		*b = (*b)[:c]
+		bufPools[i].Put(b)
+	}
+}
@@ -0,0 +1,50 @@
+package proto
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	// RawHeaderLen packLen(4) + ver(2) + cmd(4) + seq(4)
+	RawHeaderLen = int16(14)
+	// GoimHeaderLen packLen(4) + headerLen(2) + ver(2) + cmd(4) + seq(4),
+	// the goim comet layout our older clients still speak.
+	GoimHeaderLen = int16(16)
+	// DefaultMaxPackLen default limit of a whole packet (header + body).
+	DefaultMaxPackLen = int32(1 << 16)
+)
+
+// Proto is the im protocol packet.
+type Proto struct {
+	Ver   int16           `json:"ver"`  // protocol version
+	Cmd   int32           `json:"cmd"`  // operation for request
+	SeqId int32           `json:"seq"`  // sequence number chosen by client
+	Body  json.RawMessage `json:"body"` // binary body bytes(json.RawMessage is []byte)
+
+	buf *[]byte // pooled buffer backing Body, see Release
+}
+
+// Release hands the pooled body buffer back, Body must not be used after.
+// A Proto is reusable after Release, Decode reuses the buffer by itself so
+// a read loop only needs to Release once when it is done with the Proto.
+func (p *Proto) Release() {
+	if p.buf != nil {
+		putBuffer(p.buf)
+		p.buf = nil
+	}
+	p.Body = nil
+}
+
+// body returns a n bytes slice backed by the pooled buffer.
+func (p *Proto) body(n int) []byte {
+	if p.buf == nil || cap(*p.buf) < n {
+		p.Release()
+		p.buf = getBuffer(n)
+	}
+	return (*p.buf)[:n]
+}
+
+func (p *Proto) String() string {
+	return fmt.Sprintf("\n-------- proto --------\nver: %d\nop: %d\nseq: %d\nbody: %s\n", p.Ver, p.Cmd, p.SeqId, string(p.Body))
+}
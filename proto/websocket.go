@@ -0,0 +1,80 @@
+package proto
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebsocketConn carries one packet per binary message so Encoder and
+// Decoder work unchanged over websocket. Every Write is sent as one message,
+// which holds with the Encoder since it writes a whole packet per Write
+// (also through a bufio.Writer, it flushes after each packet).
+type WebsocketConn struct {
+	ws *websocket.Conn
+	rd io.Reader
+}
+
+func NewWebsocketConn(ws *websocket.Conn) *WebsocketConn {
+	return &WebsocketConn{ws: ws}
+}
+
+// Read streams the binary messages back to back, text messages are skipped.
+func (c *WebsocketConn) Read(b []byte) (n int, err error) {
+	for {
+		if c.rd == nil {
+			var mt int
+			if mt, c.rd, err = c.ws.NextReader(); err != nil {
+				return
+			}
+			if mt != websocket.BinaryMessage {
+				c.rd = nil
+				continue
+			}
+		}
+		if n, err = c.rd.Read(b); err == io.EOF {
+			c.rd = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return
+	}
+}
+
+func (c *WebsocketConn) Write(b []byte) (int, error) {
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *WebsocketConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *WebsocketConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *WebsocketConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *WebsocketConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *WebsocketConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+func (c *WebsocketConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"go-test/proto"
+)
+
+const (
+	defaultCallTimeout = 5 * time.Second
+)
+
+var (
+	ErrClientClosed = errors.New("client closed")
+)
+
+// PushFunc handles a packet no Call waits for, p is only valid during the call.
+type PushFunc func(p *proto.Proto)
+
+// Client matches replies to requests by SeqId. Requests use SeqId 1 and up,
+// server pushes carry SeqId 0 (or any SeqId nobody waits for) and go to
+// the PushFunc registered for their cmd.
+type Client struct {
+	conn    net.Conn
+	enc     *proto.Encoder
+	dec     *proto.Decoder
+	ver     int16
+	timeout time.Duration
+
+	wLock sync.Mutex // enc is not safe for concurrent use
+	wp    proto.Proto
+
+	lock     sync.Mutex
+	seqId    int32
+	pending  map[int32]chan *proto.Proto
+	handlers map[int32]PushFunc
+	err      error
+	closed   chan struct{}
+}
+
+func NewClient(conn net.Conn, enc *proto.Encoder, dec *proto.Decoder, ver int16) *Client {
+	return &Client{
+		conn:     conn,
+		enc:      enc,
+		dec:      dec,
+		ver:      ver,
+		timeout:  defaultCallTimeout,
+		pending:  make(map[int32]chan *proto.Proto),
+		handlers: make(map[int32]PushFunc),
+		closed:   make(chan struct{}),
+	}
+}
+
+// SetTimeout is the deadline of a Call whose ctx has none.
+func (c *Client) SetTimeout(d time.Duration) {
+	c.timeout = d
+}
+
+// Handle registers fn for packets of cmd that answer no pending Call.
+func (c *Client) Handle(cmd int32, fn PushFunc) {
+	c.lock.Lock()
+	c.handlers[cmd] = fn
+	c.lock.Unlock()
+}
+
+func (c *Client) nextSeq() int32 {
+	c.lock.Lock()
+	if c.seqId++; c.seqId <= 0 {
+		c.seqId = 1
+	}
+	seqId := c.seqId
+	c.lock.Unlock()
+	return seqId
+}
+
+func (c *Client) write(cmd, seqId int32, body interface{}) (err error) {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	p := &c.wp
+	p.Ver, p.Cmd, p.SeqId = c.ver, cmd, seqId
+	if body == nil {
+		p.Body = nil
+	} else if err = p.SetBody(body); err != nil {
+		return
+	}
+	return c.enc.Encode(p)
+}
+
+// Send is fire and forget, any reply goes to the PushFunc of its cmd.
+func (c *Client) Send(cmd int32, body interface{}) error {
+	return c.write(cmd, c.nextSeq(), body)
+}
+
+// Call sends a request and waits for the packet carrying its SeqId, until
+// ctx is done or the client timeout when ctx has no deadline.
+func (c *Client) Call(ctx context.Context, cmd int32, body interface{}) (*proto.Proto, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	seqId := c.nextSeq()
+	ch := make(chan *proto.Proto, 1)
+	c.lock.Lock()
+	if c.err != nil {
+		err := c.err
+		c.lock.Unlock()
+		return nil, err
+	}
+	c.pending[seqId] = ch
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, seqId)
+		c.lock.Unlock()
+	}()
+
+	if err := c.write(cmd, seqId, body); err != nil {
+		return nil, err
+	}
+	select {
+	case p := <-ch:
+		return p, nil
+	case <-c.closed:
+		return nil, c.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Serve reads until the connection fails, then fails every pending Call.
+func (c *Client) Serve() (err error) {
+	p := new(proto.Proto)
+	defer p.Release()
+	for {
+		if err = c.dec.Decode(p); err != nil {
+			c.fail(err)
+			return
+		}
+		c.lock.Lock()
+		ch, ok := c.pending[p.SeqId]
+		fn := c.handlers[p.Cmd]
+		c.lock.Unlock()
+		if ok && p.SeqId != 0 {
+			// the reply outlives the next Decode, give it its own body.
+			reply := &proto.Proto{Ver: p.Ver, Cmd: p.Cmd, SeqId: p.SeqId}
+			reply.Body = append([]byte(nil), p.Body...)
+			select {
+			case ch <- reply:
+			default: // duplicated reply
+			}
+		} else if fn != nil {
+			fn(p)
+		}
+	}
+}
+
+func (c *Client) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.closed)
+}
+
+// Err is the error that stopped the client, nil while it runs.
+func (c *Client) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+func (c *Client) Close() error {
+	c.fail(ErrClientClosed)
+	return c.conn.Close()
+}
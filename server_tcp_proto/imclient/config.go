@@ -3,6 +3,10 @@ package main
 import (
 	"flag"
 	"runtime"
+	"time"
+
+	"go-test/common/sockopt"
+	"go-test/proto"
 
 	"github.com/Terry-Mao/goconf"
 )
@@ -24,13 +28,38 @@ type Config struct {
 	Log     string `goconf:"base:log"`
 	MaxProc int    `goconf:"base:maxproc"`
 	// cert
-	CertFile string `goconf:"cert:cert.file"`
+	CertFile       string `goconf:"cert:cert.file"`
+	ClientCertFile string `goconf:"cert:client.cert.file"`
+	ClientKeyFile  string `goconf:"cert:client.key.file"`
+	// crypto
+	RSAPublic string `goconf:"crypto:rsa.public"`
 	// proto section
-	TCPAddr       string `goconf:"proto:tcp.addr"`
-	WebsocketAddr string `goconf:"proto:websocket.addr"`
-	Sndbuf        int    `goconf:"proto:sndbuf:memory"`
-	Rcvbuf        int    `goconf:"proto:rcvbuf:memory"`
-	Type          int    `goconf:"proto:type"`
+	TCPAddr           string        `goconf:"proto:tcp.addr"`
+	TLSAddr           string        `goconf:"proto:tls.addr"`
+	WebsocketAddr     string        `goconf:"proto:websocket.addr"`
+	WebsocketTLSAddr  string        `goconf:"proto:websocket.tls.addr"`
+	Sndbuf            int           `goconf:"proto:sndbuf:memory"`
+	Rcvbuf            int           `goconf:"proto:rcvbuf:memory"`
+	NoDelay           bool          `goconf:"proto:nodelay"`
+	KeepAlive         time.Duration `goconf:"proto:keepalive:time"`
+	KeepAliveInterval time.Duration `goconf:"proto:keepalive.interval:time"`
+	KeepAliveCount    int           `goconf:"proto:keepalive.count"`
+	Linger            int           `goconf:"proto:linger"`
+	Type              int           `goconf:"proto:type"`
+	HeaderLen         int           `goconf:"proto:header.len"`
+	Ver               int           `goconf:"proto:ver"`
+	Compress          int           `goconf:"proto:compress"`
+	CompressMin       int           `goconf:"proto:compress.threshold:memory"`
+	// heartbeat
+	Heartbeat        time.Duration `goconf:"heartbeat:heartbeat:time"`
+	HeartbeatTimeout time.Duration `goconf:"heartbeat:heartbeat.timeout:time"`
+	ReconnectDelay   time.Duration `goconf:"heartbeat:reconnect.delay:time"`
+	ReconnectMax     time.Duration `goconf:"heartbeat:reconnect.max:time"`
+	// user
+	UserID   uint32 `goconf:"user:user.id"`
+	Device   string `goconf:"user:device"`
+	Token    string `goconf:"user:token"`
+	FriendID uint32 `goconf:"user:friend.id"`
 	// sub
 	SubKey string `goconf:sub:sub.key`
 }
@@ -43,16 +72,49 @@ func NewConfig() *Config {
 		Log:     "./log.xml",
 		MaxProc: runtime.NumCPU(),
 		// proto section
-		TCPAddr:       "localhost:8080",
-		WebsocketAddr: "localhost:8090",
-		Sndbuf:        2048,
-		Rcvbuf:        256,
-		Type:          ProtoTCP,
+		TCPAddr:           "localhost:8080",
+		TLSAddr:           "localhost:8081",
+		WebsocketAddr:     "localhost:8090",
+		WebsocketTLSAddr:  "localhost:8091",
+		Sndbuf:            2048,
+		Rcvbuf:            256,
+		NoDelay:           true,
+		KeepAlive:         60 * time.Second,
+		KeepAliveInterval: 10 * time.Second,
+		KeepAliveCount:    3,
+		Linger:            -1,
+		Type:              ProtoTCP,
+		HeaderLen:         int(proto.RawHeaderLen),
+		Ver:               int(proto.VerJSON),
+		Compress:          int(proto.CompressNone),
+		CompressMin:       proto.DefaultCompressThreshold,
+		// heartbeat
+		Heartbeat:        30 * time.Second,
+		HeartbeatTimeout: 10 * time.Second,
+		ReconnectDelay:   time.Second,
+		ReconnectMax:     30 * time.Second,
+		// user
+		UserID:   11,
+		Device:   "imclient",
+		FriendID: 22,
 		// sub
 		SubKey: "Terry-Mao",
 	}
 }
 
+// SockOptions are the [proto] socket options of dialed connections.
+func (c *Config) SockOptions() *sockopt.Options {
+	return &sockopt.Options{
+		Sndbuf:            c.Sndbuf,
+		Rcvbuf:            c.Rcvbuf,
+		NoDelay:           c.NoDelay,
+		KeepAlive:         c.KeepAlive,
+		KeepAliveInterval: c.KeepAliveInterval,
+		KeepAliveCount:    c.KeepAliveCount,
+		Linger:            c.Linger,
+	}
+}
+
 // InitConfig init the global config.
 func InitConfig() (err error) {
 	Conf = NewConfig()
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"go-test/proto"
+)
+
+var (
+	ErrHandshakeReply = errors.New("unexpected handshake reply")
+)
+
+// handshake sends a session key encrypted with the server's rsa public key
+// and switches enc and dec to the session cipher.
+func handshake(enc *proto.Encoder, dec *proto.Decoder, p *proto.Proto, seqId int32) (err error) {
+	pub, err := proto.LoadRSAPublicKey(Conf.RSAPublic)
+	if err != nil {
+		return
+	}
+	key, err := proto.NewSessionKey()
+	if err != nil {
+		return
+	}
+	aead, err := proto.NewSessionCipher(key)
+	if err != nil {
+		return
+	}
+
+	p.Ver = int16(Conf.Ver)
+	p.Cmd = proto.OP_HANDSHARE
+	p.SeqId = seqId
+	if p.Body, err = proto.EncryptSessionKey(pub, key); err != nil {
+		return
+	}
+	if err = enc.Encode(p); err != nil {
+		return
+	}
+	enc.SetCipher(aead, proto.FromClient)
+	dec.SetCipher(aead, proto.FromServer)
+
+	if err = dec.Decode(p); err != nil {
+		return
+	}
+	if p.Cmd != proto.OP_HANDSHARE_REPLY {
+		return ErrHandshakeReply
+	}
+	var ack proto.AckNotice
+	if err = p.BindBody(&ack); err != nil {
+		return
+	}
+	if ack.Code != 0 {
+		return fmt.Errorf("handshake refused: %s", ack.Info)
+	}
+	return
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	dedupSize = 4096
+)
+
+var (
+	seenFlags = newDedup(dedupSize)
+)
+
+// dedup remembers the last n keys seen.
+type dedup struct {
+	lock sync.Mutex
+	keys map[string]struct{}
+	ring []string
+	next int
+}
+
+func newDedup(n int) *dedup {
+	return &dedup{keys: make(map[string]struct{}, n), ring: make([]string, n)}
+}
+
+// seen records key and reports whether it was already there.
+func (d *dedup) seen(key string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.keys[key]; ok {
+		return true
+	}
+	if old := d.ring[d.next]; old != "" {
+		delete(d.keys, old)
+	}
+	d.ring[d.next] = key
+	d.next = (d.next + 1) % len(d.ring)
+	d.keys[key] = struct{}{}
+	return false
+}
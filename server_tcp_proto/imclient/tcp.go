@@ -2,187 +2,262 @@ package main
 
 import (
 	"bufio"
-	"encoding/binary"
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"strconv"
 	"time"
 
+	"go-test/common/sockopt"
+	"go-test/proto"
+
 	log "github.com/thinkboy/log4go"
 )
 
-type ReqRelationUser struct {
-	MsgFlag      string `json:"msg_flag"`
-	RelationType uint32 `json:"relation_type"`
-	UserID       uint32 `json:"userId"`
-	ObjectID     uint32 `json:"object_id"`
+// dial connects with the transport of proto:type.
+func dial() (conn net.Conn, addr string, err error) {
+	switch Conf.Type {
+	case ProtoWebsocket:
+		addr = "ws://" + Conf.WebsocketAddr + "/sub"
+		conn, err = dialWebsocket(addr, nil)
+	case ProtoWebsocketTLS:
+		addr = "wss://" + Conf.WebsocketTLSAddr + "/sub"
+		var cfg *tls.Config
+		if cfg, err = newTLSConfig(); err == nil {
+			conn, err = dialWebsocket(addr, cfg)
+		}
+	case ProtoTCPTLS:
+		addr = Conf.TLSAddr
+		var cfg *tls.Config
+		if cfg, err = newTLSConfig(); err == nil {
+			conn, err = dialTLS(addr, cfg)
+		}
+	default:
+		addr = Conf.TCPAddr
+		conn, err = dialTCP(addr)
+	}
+	return
 }
 
-type AckRelationUser struct {
-	Code    int    `json:"code"`
-	Info    string `json:"info"`
-	MsgFlag string `json:"msg_flag"`
+// dialTCP dials addr with the socket options of [proto] and logs what the
+// kernel made of them.
+func dialTCP(addr string) (*net.TCPConn, error) {
+	conn, err := sockopt.Dial(addr, Conf.SockOptions())
+	if err != nil {
+		return nil, err
+	}
+	if e, err := sockopt.Read(conn); err == nil {
+		log.Info("%s socket %s", addr, e)
+	}
+	return conn, nil
 }
 
-func initTCP() {
-	log.Trace("initTcp")
-	log.Debug(Conf.TCPAddr)
-
-	conn, err := net.Dial("tcp", Conf.TCPAddr)
+func dialTLS(addr string, cfg *tls.Config) (net.Conn, error) {
+	tcpConn, err := dialTCP(addr)
 	if err != nil {
-		fmt.Println("net.Dial(\"%s\") error(%v)", Conf.TCPAddr, err)
-		log.Error("net.Dial(\"%s\") error(%v)", Conf.TCPAddr, err)
-		return
+		return nil, err
+	}
+	if cfg.ServerName == "" {
+		host, _, _ := net.SplitHostPort(addr)
+		cfg = cfg.Clone()
+		cfg.ServerName = host
 	}
+	conn := tls.Client(tcpConn, cfg)
+	if err = conn.Handshake(); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
 
-	log.Trace(Conf.TCPAddr)
+// authUser binds the connection to user.id on imserver.
+func authUser(client *Client) error {
+	p, err := client.Call(context.Background(), proto.OP_AUTH, &proto.ReqAuth{UserID: Conf.UserID, Device: Conf.Device, Token: Conf.Token})
+	if err != nil {
+		return err
+	}
+	var ack proto.AckNotice
+	if err = p.BindBody(&ack); err != nil {
+		return err
+	}
+	if ack.Code != proto.CODE_OK {
+		return fmt.Errorf("auth refused: %s", ack.Info)
+	}
+	log.Debug("auth ok, user %d", Conf.UserID)
+	return nil
+}
 
-	seqId := int32(0)
-	wr := bufio.NewWriter(conn)
-	rd := bufio.NewReader(conn)
-	proto := new(Proto)
-	proto.Ver = 1
+// acceptPush acks the push, duplicates too since imserver sends a push
+// again when the ack got lost, and reports whether it is new. MsgFlags are
+// chosen by the senders, they only tell notices of one sender apart.
+func acceptPush(client *Client, seenIDs *dedup, msgID uint64, userID uint32, msgFlag string) bool {
+	dup := false
+	if msgID != 0 {
+		if err := client.Send(OP_PUSH_ACK, &proto.ReqPushAck{MsgID: msgID}); err != nil {
+			log.Error("client.Send(OP_PUSH_ACK) error(%v)", err)
+		}
+		dup = seenIDs.seen(strconv.FormatUint(msgID, 10))
+	}
+	if msgFlag != "" && seenFlags.seen(fmt.Sprintf("%d:%s", userID, msgFlag)) {
+		dup = true
+	}
+	return !dup
+}
 
-	// writer
-	go func() {
-		proto1 := new(Proto)
+// initTCP keeps a connection up, dialing again with backoff whenever it
+// drops.
+func initTCP() {
+	log.Trace("initTcp")
 
-		proto1.Ver = 1
-		for {
-			var emptyJSONBody = []byte("{}")
-			oRlatUser := ReqRelationUser{"123", 2, 11, 22}
-			if b, err := json.Marshal(oRlatUser); err == nil {
-				proto1.Body = b
-			} else {
-				proto1.Body = emptyJSONBody
-			}
-			// relation user.
-			log.Debug("relation user...")
-			proto1.Cmd = OP_TEST_REATION_USER
-			proto1.SeqId = seqId
-			//proto1.Body = nil
-			if err = tcpWriteProto(wr, proto1); err != nil {
-				log.Error("tcpWriteProto() error(%v)", err)
-				return
-			}
-			seqId++
-			time.Sleep(10000 * time.Millisecond)
-		}
-	}()
-	// reader
+	delay := Conf.ReconnectDelay
 	for {
-		log.Debug("tcpReadProto")
-
-		if err = tcpReadProto(rd, proto); err != nil {
-			log.Error("tcpReadProto() error(%v)", err)
-			return
+		if serveTCP() {
+			delay = Conf.ReconnectDelay
 		}
+		log.Info("reconnect in %v", delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > Conf.ReconnectMax {
+			delay = Conf.ReconnectMax
+		}
+	}
+}
 
-		if proto.Cmd == OP_TEST_REATION_USER_REPLY {
-			log.Debug("ack relation user-----")
-			var oObj AckRelationUser
-			body, _ := proto.Body.MarshalJSON()
-			if err := json.Unmarshal(body, &oObj); err != nil {
-				log.Error(err)
-			}
-
-			log.Debug("body = %v", oObj)
-		} else if proto.Cmd == OP_HEARTBEAT_REPLY {
-			log.Debug("receive heartbeat")
-			if err = conn.SetReadDeadline(time.Now().Add(25 * time.Second)); err != nil {
-				log.Error("conn.SetReadDeadline() error(%v)", err)
-				return
+// heartbeat sends OP_HEARTBEAT every Conf.Heartbeat and closes the client
+// when a reply does not come back in time.
+func heartbeat(client *Client) {
+	ticker := time.NewTicker(Conf.Heartbeat)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), Conf.HeartbeatTimeout)
+		_, err := client.Call(ctx, proto.OP_HEARTBEAT, nil)
+		cancel()
+		if err != nil {
+			if client.Err() == nil {
+				log.Error("heartbeat error(%v), closing", err)
+				client.Close()
 			}
-		} else if proto.Cmd == OP_TEST_REPLY {
-			log.Debug("body: %s", string(proto.Body))
-		} else if proto.Cmd == OP_SEND_SMS_REPLY {
-			log.Debug("body: %s", string(proto.Body))
+			return
 		}
+		log.Debug("receive heartbeat")
 	}
 }
 
-func tcpWriteProto(wr *bufio.Writer, proto *Proto) (err error) {
-	// write
-	log.Debug("packet len = %d", uint32(rawHeaderLen)+uint32(len(proto.Body)))
-	if err = binary.Write(wr, binary.BigEndian, uint32(rawHeaderLen)+uint32(len(proto.Body))); err != nil {
-		return
+// serveTCP runs one connection until it fails, it reports whether it got
+// connected at all.
+func serveTCP() bool {
+	conn, addr, err := dial()
+	if err != nil {
+		fmt.Printf("dial(\"%s\") error(%v)\n", addr, err)
+		log.Error("dial(\"%s\") error(%v)", addr, err)
+		return false
 	}
-	//if err = binary.Write(wr, binary.BigEndian, rawHeaderLen); err != nil {
-	//	return
-	//}
 
-	log.Debug("ver = %d", proto.Ver)
-	if err = binary.Write(wr, binary.BigEndian, proto.Ver); err != nil {
-		return
-	}
+	log.Trace(addr)
 
-	log.Debug("oper = %d", proto.Cmd)
-	if err = binary.Write(wr, binary.BigEndian, proto.Cmd); err != nil {
-		return
+	enc := proto.NewEncoder(bufio.NewWriter(conn))
+	dec := proto.NewDecoder(bufio.NewReader(conn))
+	if err = enc.SetHeaderLen(int16(Conf.HeaderLen)); err != nil {
+		log.Error("header.len %d error(%v)", Conf.HeaderLen, err)
+		conn.Close()
+		return false
+	}
+	dec.SetHeaderLen(int16(Conf.HeaderLen))
+	if err = enc.SetCompress(int16(Conf.Compress), Conf.CompressMin); err != nil {
+		log.Error("compress %d error(%v)", Conf.Compress, err)
+		conn.Close()
+		return false
 	}
 
-	log.Debug("seqid = %d", proto.SeqId)
-	if err = binary.Write(wr, binary.BigEndian, proto.SeqId); err != nil {
-		return
+	if Conf.RSAPublic != "" {
+		if err = handshake(enc, dec, new(proto.Proto), 0); err != nil {
+			log.Error("handshake() error(%v)", err)
+			conn.Close()
+			return false
+		}
+		log.Debug("handshake ok")
 	}
-	if proto.Body != nil {
-		log.Debug("cipher body: %v", proto.Body)
-		if err = binary.Write(wr, binary.BigEndian, proto.Body); err != nil {
+
+	client := NewClient(conn, enc, dec, int16(Conf.Ver))
+	// MsgIDs are per connection, MsgFlags outlive it.
+	seenIDs := newDedup(dedupSize)
+	client.Handle(proto.OP_DISCONNECT_REPLY, func(p *proto.Proto) {
+		log.Info("imserver asked to disconnect: %s", string(p.Body))
+		client.Close()
+	})
+	client.Handle(proto.OP_TEST_REPLY, func(p *proto.Proto) {
+		log.Debug("body: %s", string(p.Body))
+	})
+	client.Handle(proto.OP_SEND_SMS_REPLY, func(p *proto.Proto) {
+		log.Debug("body: %s", string(p.Body))
+	})
+	client.Handle(OP_PUSH_NOTICE_FRIEND, func(p *proto.Proto) {
+		var oObj proto.ReqNoticeFriend
+		if err := p.BindBody(&oObj); err != nil {
+			log.Error(err)
 			return
 		}
-	}
-	err = wr.Flush()
-	return
-}
+		if !acceptPush(client, seenIDs, oObj.MsgID, oObj.UserID, oObj.MsgFlag) {
+			log.Debug("duplicated friend notice %d %s", oObj.MsgID, oObj.MsgFlag)
+			return
+		}
+		log.Debug("friend notice from %d: %+v", oObj.UserID, oObj)
+	})
+	client.Handle(OP_PUSH_NOTICE_GROUP, func(p *proto.Proto) {
+		var oObj proto.ReqNoticeGroup
+		if err := p.BindBody(&oObj); err != nil {
+			log.Error(err)
+			return
+		}
+		if !acceptPush(client, seenIDs, oObj.MsgID, oObj.UserID, oObj.MsgFlag) {
+			log.Debug("duplicated group notice %d %s", oObj.MsgID, oObj.MsgFlag)
+			return
+		}
+		log.Debug("group %d notice from %d: %+v", oObj.GroupID, oObj.UserID, oObj)
+	})
+	client.Handle(OP_PUSH_ACK_REPLY, func(p *proto.Proto) {
+		var oObj proto.AckNotice
+		if err := p.BindBody(&oObj); err != nil || oObj.Code != proto.CODE_OK {
+			log.Error("push ack refused: %v %v", err, oObj)
+		}
+	})
 
-func tcpReadProto(rd *bufio.Reader, proto *Proto) (err error) {
-	var (
-		packLen int32
-	)
-	// read
-	if err = binary.Read(rd, binary.BigEndian, &packLen); err != nil {
-		return
-	}
-
-	log.Debug("packLen: %d", packLen)
-	if err = binary.Read(rd, binary.BigEndian, &headerLen); err != nil {
-		return
-	}
-	log.Debug("headerLen: %d", headerLen)
-
-	if err = binary.Read(rd, binary.BigEndian, &proto.Ver); err != nil {
-		return
-	}
-	log.Debug("ver: %d", proto.Ver)
-	if err = binary.Read(rd, binary.BigEndian, &proto.Cmd); err != nil {
-		return
-	}
-	log.Debug("operation: %d", proto.Cmd)
-	if err = binary.Read(rd, binary.BigEndian, &proto.SeqId); err != nil {
-		return
-	}
-	log.Debug("seqId: %d", proto.SeqId)
-	var (
-		n = int(0)
-		t = int(0)
-		//	bodyLen = int(packLen - int32(headerLen))
-		bodyLen = int(packLen - int32(rawHeaderLen))
-	)
-	log.Debug("read body len: %d", bodyLen)
-	if bodyLen > 0 {
-		proto.Body = make([]byte, bodyLen)
+	// writer
+	go func() {
+		if err := authUser(client); err != nil {
+			log.Error("authUser() error(%v)", err)
+			client.Close()
+			return
+		}
 		for {
-			if t, err = rd.Read(proto.Body[n:]); err != nil {
-				return
-			}
-			if n += t; n == bodyLen {
-				break
-			} else if n < bodyLen {
+			// relation user.
+			log.Debug("relation user...")
+			// every notice gets a flag of its own, receivers drop the ones
+			// they saw.
+			msgFlag := strconv.FormatInt(time.Now().UnixNano(), 10)
+			oRlatUser := &proto.ReqNoticeFriend{MsgFlag: msgFlag, RelationType: 2, UserID: Conf.UserID, ObjectID: Conf.FriendID}
+			p, err := client.Call(context.Background(), OP_TEST_REATION_USER, oRlatUser)
+			if err != nil {
+				log.Error("client.Call() error(%v)", err)
+				if client.Err() != nil {
+					return
+				}
 			} else {
+				log.Debug("ack relation user-----")
+				var oObj proto.AckNotice
+				if err := p.BindBody(&oObj); err != nil {
+					log.Error(err)
+				}
+				log.Debug("body = %v", oObj)
 			}
+			time.Sleep(10000 * time.Millisecond)
 		}
-	} else {
-		proto.Body = nil
+	}()
+	go heartbeat(client)
+	// reader
+	if err = client.Serve(); err != nil {
+		log.Error("client.Serve() error(%v)", err)
 	}
-	return
+	client.Close()
+	return true
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+var (
+	ErrCertFile = errors.New("no certificate in cert file")
+)
+
+// newTLSConfig trusts the server certificate of cert.file and presents the
+// client certificate when the server verifies clients.
+func newTLSConfig() (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(Conf.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, ErrCertFile
+	}
+	cfg := &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+	if Conf.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(Conf.ClientCertFile, Conf.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+
+	"go-test/proto"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialWebsocket dials a ws or wss url, packets travel as binary messages.
+func dialWebsocket(url string, cfg *tls.Config) (net.Conn, error) {
+	dialer := &websocket.Dialer{
+		Proxy:           websocket.DefaultDialer.Proxy,
+		TLSClientConfig: cfg,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			return dialTCP(addr)
+		},
+	}
+	ws, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return proto.NewWebsocketConn(ws), nil
+}
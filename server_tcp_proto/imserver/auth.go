@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"go-test/common/token"
+	"go-test/proto"
+
+	log "github.com/thinkboy/log4go"
+)
+
+var (
+	authenticator Authenticator
+
+	ErrAuthUser   = errors.New("token is for another user")
+	ErrAuthDevice = errors.New("token is for another device")
+
+	errNotAuthed = &CodeError{Code: proto.CODE_NOT_AUTHED, Info: "not authenticated"}
+)
+
+// Authenticator checks the credentials of an OP_AUTH and returns the user
+// ID the session is bound to. A connection not authenticated within
+// handshake.timeout is closed.
+type Authenticator interface {
+	Auth(r *proto.ReqAuth) (userID uint32, err error)
+}
+
+// HMACAuth accepts tokens the token service signed and did not revoke,
+// they must be for the device and the user ID (when not 0) of the request.
+type HMACAuth struct {
+	Verifier *token.Verifier
+}
+
+func (a *HMACAuth) Auth(r *proto.ReqAuth) (uint32, error) {
+	c, err := a.Verifier.Verify(r.Token, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	if r.UserID != 0 && r.UserID != c.UserID {
+		return 0, ErrAuthUser
+	}
+	if c.Device != "" && c.Device != r.Device {
+		return 0, ErrAuthDevice
+	}
+	return c.UserID, nil
+}
+
+// TrustAuth takes the user ID the client claims, for tests only.
+type TrustAuth struct{}
+
+func (TrustAuth) Auth(r *proto.ReqAuth) (uint32, error) {
+	return r.UserID, nil
+}
+
+func initAuth() {
+	if Conf.AuthKey == "" {
+		// Validate let it through for auth.insecure only.
+		log.Error("auth.insecure: OP_AUTH trusts the user id clients claim, anyone can be anyone, never run it like this in production")
+		authenticator = TrustAuth{}
+		return
+	}
+	v := &token.Verifier{Key: []byte(Conf.AuthKey)}
+	if Conf.RedisAddr != "" {
+		v.Pool = redisPool
+	} else {
+		log.Warn("no redis.addr, revoked tokens are accepted")
+	}
+	authenticator = &HMACAuth{Verifier: v}
+}
+
+// requireAuth is the Auth middleware check, only OP_AUTH goes through
+// before the session is bound.
+func requireAuth(c *Context) error {
+	if c.Req.Cmd != proto.OP_AUTH && c.Session.UserID() == 0 {
+		return errNotAuthed
+	}
+	return nil
+}
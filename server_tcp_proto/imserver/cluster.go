@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	log "github.com/thinkboy/log4go"
+)
+
+const (
+	// users refreshed with one pipeline.
+	onlineBatch = 512
+
+	// locks Register and Unregister of users are serialized by.
+	userLocks = 256
+
+	subscribeDelay    = time.Second
+	maxSubscribeDelay = 30 * time.Second
+)
+
+var (
+	cluster *Cluster
+)
+
+// onlineKey is a hash of the nodes userID is online on, node id -> unix
+// time the entry expires. Entries of a node that died expire on their own.
+func onlineKey(userID uint32) string {
+	return fmt.Sprintf("online:%d", userID)
+}
+
+// nodeChannel carries the pushes forwarded to node.
+func nodeChannel(node string) string {
+	return "node:" + node
+}
+
+// forward is a push for users online on the receiving node.
+type forward struct {
+	From    string          `json:"from"`
+	UserIDs []uint32        `json:"user_ids"`
+	Cmd     int32           `json:"cmd"`
+	Body    json.RawMessage `json:"body"`
+}
+
+// Cluster registers the users of this node in redis and forwards pushes for
+// users on other nodes over redis pub/sub, the receiving node delivers them
+// as its own.
+type Cluster struct {
+	pool  *redis.Pool
+	addr  string
+	node  string
+	ttl   time.Duration
+	locks [userLocks]sync.Mutex
+}
+
+func NewCluster(pool *redis.Pool, addr, node string, ttl time.Duration) *Cluster {
+	return &Cluster{pool: pool, addr: addr, node: node, ttl: ttl}
+}
+
+// initCluster joins cluster:node.id, it needs redis.
+func initCluster() {
+	if Conf.NodeID == "" {
+		return
+	}
+	cluster = NewCluster(redisPool, Conf.RedisAddr, Conf.NodeID, Conf.OnlineTTL)
+	go cluster.subscribe()
+	go cluster.refresh()
+	log.Info("cluster node = %s", Conf.NodeID)
+}
+
+func (c *Cluster) expire() int64 {
+	return time.Now().Add(c.ttl).Unix()
+}
+
+func (c *Cluster) lock(userID uint32) *sync.Mutex {
+	return &c.locks[userID%userLocks]
+}
+
+// Register records userID online on this node, call it once the session
+// is bound.
+func (c *Cluster) Register(userID uint32) error {
+	l := c.lock(userID)
+	l.Lock()
+	defer l.Unlock()
+	conn := c.pool.Get()
+	defer conn.Close()
+	c.sendRegister(conn, userID, c.expire())
+	_, err := conn.Do("")
+	return err
+}
+
+func (c *Cluster) sendRegister(conn redis.Conn, userID uint32, expire int64) {
+	key := onlineKey(userID)
+	conn.Send("HSET", key, c.node, expire)
+	conn.Send("EXPIRE", key, int64(c.ttl/time.Second)+1)
+}
+
+// Unregister removes this node from the nodes of userID unless the user
+// still has a session here. The check and the removal hold the lock of
+// Register, so a device logging in meanwhile is never removed.
+func (c *Cluster) Unregister(userID uint32) error {
+	l := c.lock(userID)
+	l.Lock()
+	defer l.Unlock()
+	if sessions.Online(userID) {
+		return nil
+	}
+	conn := c.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("HDEL", onlineKey(userID), c.node)
+	return err
+}
+
+// refresh registers the users of this node again every third of the ttl,
+// so their entries outlive it only while the node runs.
+func (c *Cluster) refresh() {
+	for range time.Tick(c.ttl / 3) {
+		userIDs := sessions.Users()
+		for len(userIDs) > 0 {
+			n := len(userIDs)
+			if n > onlineBatch {
+				n = onlineBatch
+			}
+			if err := c.registerAll(userIDs[:n]); err != nil {
+				log.Error("cluster refresh error(%v)", err)
+				break
+			}
+			userIDs = userIDs[n:]
+		}
+	}
+}
+
+func (c *Cluster) registerAll(userIDs []uint32) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+	expire := c.expire()
+	for _, userID := range userIDs {
+		c.sendRegister(conn, userID, expire)
+	}
+	_, err := conn.Do("")
+	return err
+}
+
+// Locate groups userIDs by the other nodes they are online on, a user on
+// several nodes is in each of them.
+func (c *Cluster) Locate(userIDs []uint32) (map[string][]uint32, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	for _, userID := range userIDs {
+		if err := conn.Send("HGETALL", onlineKey(userID)); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	nodes := make(map[string][]uint32)
+	for _, userID := range userIDs {
+		entries, err := redis.StringMap(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		for node, v := range entries {
+			if node == c.node {
+				continue
+			}
+			if expire, err := strconv.ParseInt(v, 10, 64); err != nil || expire < now {
+				continue
+			}
+			nodes[node] = append(nodes[node], userID)
+		}
+	}
+	return nodes, nil
+}
+
+// Forward publishes body as cmd for userIDs to node, false when no node
+// listens: it is gone.
+func (c *Cluster) Forward(node string, userIDs []uint32, cmd int32, body interface{}) (bool, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return false, err
+	}
+	msg, err := json.Marshal(&forward{From: c.node, UserIDs: userIDs, Cmd: cmd, Body: b})
+	if err != nil {
+		return false, err
+	}
+	conn := c.pool.Get()
+	defer conn.Close()
+	n, err := redis.Int(conn.Do("PUBLISH", nodeChannel(node), msg))
+	return n > 0, err
+}
+
+// subscribe receives the pushes forwarded to this node, on its own
+// connection: a subscribed connection can do nothing else. The delay
+// between attempts doubles while they fail, and starts over once one
+// subscribed.
+func (c *Cluster) subscribe() {
+	delay := subscribeDelay
+	for {
+		subscribed, err := c.receive()
+		if subscribed {
+			delay = subscribeDelay
+		}
+		log.Error("cluster subscribe error(%v), again in %v", err, delay)
+		if shuttingDown() {
+			return
+		}
+		time.Sleep(delay)
+		if delay *= 2; delay > maxSubscribeDelay {
+			delay = maxSubscribeDelay
+		}
+	}
+}
+
+// receive delivers forwarded pushes until the connection fails, subscribed
+// tells whether redis confirmed the subscription before.
+func (c *Cluster) receive() (subscribed bool, err error) {
+	conn, err := redis.Dial("tcp", c.addr)
+	if err != nil {
+		return
+	}
+	psc := redis.PubSubConn{Conn: conn}
+	defer psc.Close()
+	if err = psc.Subscribe(nodeChannel(c.node)); err != nil {
+		return
+	}
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			c.deliver(v.Data)
+		case redis.Subscription:
+			log.Info("cluster %s %s", v.Kind, v.Channel)
+			subscribed = true
+		case error:
+			return subscribed, v
+		}
+	}
+}
+
+// deliver pushes a forwarded message to the sessions of its users here,
+// users who left meanwhile get it offline.
+func (c *Cluster) deliver(data []byte) {
+	var f forward
+	if err := json.Unmarshal(data, &f); err != nil {
+		log.Error("cluster forward error(%v)", err)
+		return
+	}
+	newBody := pushBodies[f.Cmd]
+	if newBody == nil {
+		log.Warn("cluster forward from %s unknown cmd %d", f.From, f.Cmd)
+		return
+	}
+	body := newBody()
+	if err := json.Unmarshal(f.Body, body); err != nil {
+		log.Error("cluster forward from %s cmd %d error(%v)", f.From, f.Cmd, err)
+		return
+	}
+	var offlineIDs []uint32
+	for _, userID := range f.UserIDs {
+		if sessions.DeliverUser(userID, f.Cmd, body) == 0 {
+			offlineIDs = append(offlineIDs, userID)
+		}
+	}
+	log.Debug("cluster forward from %s cmd %d, %d users, %d offline", f.From, f.Cmd, len(f.UserIDs), len(offlineIDs))
+	if len(offlineIDs) > 0 && offline != nil {
+		if err := offline.Store(offlineIDs, f.Cmd, body); err != nil {
+			log.Error("cluster offline.Store() error(%v)", err)
+		}
+	}
+}
+
+// deliverUsers pushes body to userIDs on this node and, in a cluster, on
+// every other node they are online on; the users online nowhere get it
+// offline. n is the sessions reached here plus the users forwarded.
+func deliverUsers(userIDs []uint32, cmd int32, body interface{}) (n int, err error) {
+	reached := make(map[uint32]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if k := sessions.DeliverUser(userID, cmd, body); k > 0 {
+			n += k
+			reached[userID] = true
+		}
+	}
+	if cluster != nil {
+		n += forwardUsers(userIDs, cmd, body, reached)
+	}
+	if offline == nil || len(reached) == len(userIDs) {
+		return
+	}
+	offlineIDs := make([]uint32, 0, len(userIDs)-len(reached))
+	for _, userID := range userIDs {
+		if !reached[userID] {
+			offlineIDs = append(offlineIDs, userID)
+		}
+	}
+	err = offline.Store(offlineIDs, cmd, body)
+	return
+}
+
+// forwardUsers forwards body to the other nodes of userIDs and marks the
+// users it went to in reached.
+func forwardUsers(userIDs []uint32, cmd int32, body interface{}, reached map[uint32]bool) (n int) {
+	nodes, err := cluster.Locate(userIDs)
+	if err != nil {
+		log.Error("cluster.Locate() error(%v)", err)
+		return
+	}
+	for node, ids := range nodes {
+		ok, err := cluster.Forward(node, ids, cmd, body)
+		if err != nil {
+			log.Error("cluster.Forward(\"%s\") error(%v)", node, err)
+			continue
+		}
+		if !ok {
+			log.Warn("cluster node %s is gone", node)
+			continue
+		}
+		for _, userID := range ids {
+			reached[userID] = true
+		}
+		n += len(ids)
+	}
+	return
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	"go-test/common/sockopt"
+
+	"github.com/Terry-Mao/goconf"
+)
+
+var (
+	gconf    *goconf.Config
+	Conf     *Config
+	confFile string
+)
+
+func init() {
+	flag.StringVar(&confFile, "c", "./server.conf", " set server config file path")
+}
+
+type Config struct {
+	// base section
+	PidFile         string        `goconf:"base:pidfile"`
+	Log             string        `goconf:"base:log"`
+	MaxProc         int           `goconf:"base:maxproc"`
+	ShutdownTimeout time.Duration `goconf:"base:shutdown.timeout:time"`
+	// tcp
+	TCPAddr           []string      `goconf:"tcp:tcp.addr:,"`
+	Sndbuf            int           `goconf:"tcp:sndbuf:memory"`
+	Rcvbuf            int           `goconf:"tcp:rcvbuf:memory"`
+	NoDelay           bool          `goconf:"tcp:nodelay"`
+	KeepAlive         time.Duration `goconf:"tcp:keepalive:time"`
+	KeepAliveInterval time.Duration `goconf:"tcp:keepalive.interval:time"`
+	KeepAliveCount    int           `goconf:"tcp:keepalive.count"`
+	Linger            int           `goconf:"tcp:linger"`
+	NetMode           string        `goconf:"tcp:net.mode"`
+	EpollLoops        int           `goconf:"tcp:epoll.loops"`
+	// tls
+	TLSAddr      string `goconf:"tls:tls.addr"`
+	CertFile     string `goconf:"tls:cert.file"`
+	KeyFile      string `goconf:"tls:key.file"`
+	ClientCAFile string `goconf:"tls:client.ca"`
+	// websocket
+	WebsocketAddr    string `goconf:"websocket:websocket.addr"`
+	WebsocketTLSAddr string `goconf:"websocket:websocket.tls.addr"`
+	// crypto
+	RSAPrivate       string `goconf:"crypto:rsa.private"`
+	RequireHandshake bool   `goconf:"crypto:require.handshake"`
+	// auth
+	AuthKey          string        `goconf:"auth:auth.key"`
+	AuthInsecure     bool          `goconf:"auth:auth.insecure"`
+	HandshakeTimeout time.Duration `goconf:"auth:handshake.timeout:time"`
+	// session
+	MaxConn          int           `goconf:"session:maxconn"`
+	HeartbeatTimeout time.Duration `goconf:"session:heartbeat.timeout:time"`
+	WriteQueue       int           `goconf:"session:write.queue"`
+	WriteFull        string        `goconf:"session:write.full"`
+	CloseTimeout     time.Duration `goconf:"session:close.timeout:time"`
+	// push
+	PushTimeout time.Duration `goconf:"push:push.timeout:time"`
+	PushRetry   int           `goconf:"push:push.retry"`
+	OfflineMax  int           `goconf:"push:offline.max"`
+	OfflineTTL  time.Duration `goconf:"push:offline.ttl:time"`
+	// redis
+	RedisAddr        string        `goconf:"redis:redis.addr"`
+	RedisIdle        int           `goconf:"redis:redis.idle"`
+	RedisActive      int           `goconf:"redis:redis.active"`
+	RedisIdleTimeout time.Duration `goconf:"redis:redis.idle.timeout:time"`
+	// cluster
+	NodeID    string        `goconf:"cluster:node.id"`
+	OnlineTTL time.Duration `goconf:"cluster:online.ttl:time"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		// base section
+		PidFile:         "/tmp/imserver.pid",
+		Log:             "./log.xml",
+		MaxProc:         runtime.NumCPU(),
+		ShutdownTimeout: 10 * time.Second,
+		// tcp
+		TCPAddr:           []string{"127.0.0.1:8080"},
+		NoDelay:           true,
+		KeepAlive:         60 * time.Second,
+		KeepAliveInterval: 10 * time.Second,
+		KeepAliveCount:    3,
+		Linger:            -1,
+		NetMode:           netGoroutine,
+		EpollLoops:        runtime.NumCPU(),
+		// tls
+		CertFile: "./cert.pem",
+		KeyFile:  "./key.pem",
+		// crypto
+		RSAPrivate: "./pri.pem",
+		// auth
+		HandshakeTimeout: 10 * time.Second,
+		// session
+		HeartbeatTimeout: 90 * time.Second,
+		WriteQueue:       128,
+		WriteFull:        fullDisconnect,
+		CloseTimeout:     5 * time.Second,
+		// push
+		PushTimeout: 2 * time.Second,
+		PushRetry:   4,
+		OfflineMax:  100,
+		OfflineTTL:  7 * 24 * time.Hour,
+		// redis
+		RedisIdle:        16,
+		RedisActive:      128,
+		RedisIdleTimeout: 180 * time.Second,
+		// cluster
+		OnlineTTL: time.Minute,
+	}
+}
+
+// InitConfig init the global config.
+func InitConfig() (err error) {
+	Conf = NewConfig()
+	gconf = goconf.New()
+	if err = gconf.Parse(confFile); err != nil {
+		return err
+	}
+	if err = gconf.Unmarshal(Conf); err != nil {
+		return err
+	}
+	return Conf.Validate()
+}
+
+// Validate reports the first setting imserver can not run with.
+func (c *Config) Validate() error {
+	if c.MaxProc <= 0 {
+		return errors.New("base:maxproc must be positive")
+	}
+	if len(c.TCPAddr) == 0 && c.TLSAddr == "" && c.WebsocketAddr == "" && c.WebsocketTLSAddr == "" {
+		return errors.New("no tcp:tcp.addr, tls:tls.addr, websocket:websocket.addr or websocket:websocket.tls.addr to listen on")
+	}
+	for _, addr := range c.TCPAddr {
+		if _, err := net.ResolveTCPAddr("tcp", addr); err != nil {
+			return fmt.Errorf("tcp:tcp.addr %q: %v", addr, err)
+		}
+	}
+	if c.Sndbuf < 0 || c.Rcvbuf < 0 {
+		return errors.New("tcp:sndbuf and tcp:rcvbuf must not be negative")
+	}
+	if c.KeepAlive < 0 || c.KeepAliveInterval < 0 || c.KeepAliveCount < 0 {
+		return errors.New("tcp:keepalive, tcp:keepalive.interval and tcp:keepalive.count must not be negative")
+	}
+	switch c.NetMode {
+	case netGoroutine, netEpoll:
+	default:
+		return errors.New("tcp:net.mode must be goroutine or epoll")
+	}
+	if c.EpollLoops <= 0 {
+		return errors.New("tcp:epoll.loops must be positive")
+	}
+	if c.AuthKey == "" && !c.AuthInsecure {
+		return errors.New("no auth:auth.key, set auth:auth.insecure to trust the user id clients claim")
+	}
+	if c.MaxConn < 0 {
+		return errors.New("session:maxconn must not be negative, 0 is no limit")
+	}
+	if c.WriteQueue <= 0 {
+		return errors.New("session:write.queue must be positive")
+	}
+	switch c.WriteFull {
+	case fullDrop, fullBlock, fullDisconnect:
+	default:
+		return errors.New("session:write.full must be drop, block or disconnect")
+	}
+	if c.NodeID != "" && c.RedisAddr == "" {
+		return errors.New("cluster:node.id needs redis:redis.addr")
+	}
+	if c.PushRetry < 0 {
+		return errors.New("push:push.retry must not be negative")
+	}
+	if c.RedisIdle < 0 {
+		return errors.New("redis:redis.idle must not be negative")
+	}
+	if c.RedisActive < 0 {
+		return errors.New("redis:redis.active must not be negative, 0 is no limit")
+	}
+	if c.OfflineMax <= 0 {
+		return errors.New("push:offline.max must be positive")
+	}
+	for _, d := range []struct {
+		key string
+		d   time.Duration
+	}{
+		{"base:shutdown.timeout", c.ShutdownTimeout},
+		{"auth:handshake.timeout", c.HandshakeTimeout},
+		{"session:heartbeat.timeout", c.HeartbeatTimeout},
+		{"session:close.timeout", c.CloseTimeout},
+		{"push:push.timeout", c.PushTimeout},
+		{"push:offline.ttl", c.OfflineTTL},
+		{"redis:redis.idle.timeout", c.RedisIdleTimeout},
+		{"cluster:online.ttl", c.OnlineTTL},
+	} {
+		if d.d <= 0 {
+			return fmt.Errorf("%s must be positive", d.key)
+		}
+	}
+	return nil
+}
+
+// SockOptions are the [tcp] socket options of accepted connections.
+func (c *Config) SockOptions() *sockopt.Options {
+	return &sockopt.Options{
+		Sndbuf:            c.Sndbuf,
+		Rcvbuf:            c.Rcvbuf,
+		NoDelay:           c.NoDelay,
+		KeepAlive:         c.KeepAlive,
+		KeepAliveInterval: c.KeepAliveInterval,
+		KeepAliveCount:    c.KeepAliveCount,
+		Linger:            c.Linger,
+	}
+}
+
+// writePidFile records the pid in base:pidfile, empty writes none.
+func writePidFile() error {
+	if Conf.PidFile == "" {
+		return nil
+	}
+	return ioutil.WriteFile(Conf.PidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+func removePidFile() {
+	if Conf.PidFile != "" {
+		os.Remove(Conf.PidFile)
+	}
+}
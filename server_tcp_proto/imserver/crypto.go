@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rsa"
+	"errors"
+
+	"go-test/proto"
+
+	log "github.com/thinkboy/log4go"
+)
+
+var (
+	rsaPrivateKey *rsa.PrivateKey
+
+	ErrNoRSAKey          = errors.New("handshake not supported, no rsa private key")
+	ErrHandshakeRequired = errors.New("packet before the handshake")
+)
+
+// initCrypto loads the handshake key, without it the server only talks
+// plaintext. crypto:require.handshake does not start without it.
+func initCrypto() (err error) {
+	if rsaPrivateKey, err = proto.LoadRSAPrivateKey(Conf.RSAPrivate); err != nil {
+		if Conf.RequireHandshake {
+			return
+		}
+		log.Warn("proto.LoadRSAPrivateKey(\"%s\") error(%v)", Conf.RSAPrivate, err)
+	}
+	return nil
+}
+
+// handshake takes the session key out of an OP_HANDSHARE and switches the
+// connection to the session cipher, the reply is already encrypted.
+func handshake(s *Session, p *proto.Proto) (err error) {
+	var (
+		key  []byte
+		aead cipher.AEAD
+	)
+	reply := &proto.Proto{Ver: p.Ver, Cmd: proto.OP_HANDSHARE_REPLY, SeqId: p.SeqId}
+	if rsaPrivateKey == nil {
+		err = ErrNoRSAKey
+	} else if key, err = proto.DecryptSessionKey(rsaPrivateKey, p.Body); err == nil {
+		aead, err = proto.NewSessionCipher(key)
+	}
+	if err != nil {
+		SendAck(s, reply, &proto.AckNotice{Code: proto.CODE_FAILED, Info: err.Error()})
+		return
+	}
+
+	s.setCipher(aead)
+	return SendAck(s, reply, &proto.AckNotice{Code: proto.CODE_OK, Info: "ok"})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"go-test/common/timer"
+	"go-test/proto"
+
+	log "github.com/thinkboy/log4go"
+)
+
+const (
+	maxPushBackoff = 30 * time.Second
+)
+
+var (
+	ErrSessionClosed = errors.New("session closed")
+)
+
+// pending is a push waiting for its ack. Pushes never acked are kept
+// offline when the session goes, offlineID is set when it came from there.
+type pending struct {
+	id        uint64
+	cmd       int32
+	body      interface{}
+	m         *message
+	offlineID uint64
+	user      *userPush
+	tries     int
+	timer     *timer.Timer
+}
+
+// userPush is one push to every session of a user, each device has it
+// pending under its own MsgID but it is stored offline once.
+type userPush struct {
+	stored int32
+}
+
+// withMsgID is a copy of body carrying id, bodies without a MsgID are
+// returned as is.
+func withMsgID(body interface{}, id uint64) interface{} {
+	switch b := body.(type) {
+	case *proto.ReqNoticeFriend:
+		c := *b
+		c.MsgID = id
+		return &c
+	case *proto.ReqNoticeGroup:
+		c := *b
+		c.MsgID = id
+		return &c
+	}
+	return body
+}
+
+func pushBackoff(tries int) time.Duration {
+	d := Conf.PushTimeout << uint(tries)
+	if d <= 0 || d > maxPushBackoff {
+		d = maxPushBackoff
+	}
+	return d
+}
+
+// Deliver pushes body as cmd with the next MsgID of the session and sends
+// it again with backoff until the client acks it, offlineID is the id of
+// the stored message it comes from, 0 for none.
+func (s *Session) Deliver(cmd int32, body interface{}, offlineID uint64) error {
+	return s.deliver(cmd, body, offlineID, nil)
+}
+
+// deliver is Deliver of a push shared by the sessions of the user, see
+// userPush.
+func (s *Session) deliver(cmd int32, body interface{}, offlineID uint64, up *userPush) error {
+	s.pLock.Lock()
+	if s.closed {
+		s.pLock.Unlock()
+		return ErrSessionClosed
+	}
+	s.msgSeq++
+	pd := &pending{id: s.msgSeq, cmd: cmd, offlineID: offlineID, user: up}
+	pd.body = withMsgID(body, pd.id)
+	pd.m = newMessage(cmd, pd.body)
+	s.pending[pd.id] = pd
+	// the wheel goroutine must not block on the write.
+	pd.timer = s.wheel.AfterFunc(pushBackoff(0), func() { go s.retransmit(pd) })
+	s.pLock.Unlock()
+	// a failed write is sent again, or stored when the session goes.
+	if err := s.push(pd.m); err != nil {
+		log.Debug("session %d push %d error(%v)", s.ID, pd.id, err)
+	}
+	return nil
+}
+
+func (s *Session) retransmit(pd *pending) {
+	s.pLock.Lock()
+	if s.closed || s.pending[pd.id] != pd {
+		s.pLock.Unlock()
+		return
+	}
+	if pd.tries++; pd.tries > Conf.PushRetry {
+		s.pLock.Unlock()
+		log.Warn("session %d user %d push %d not acked, closing", s.ID, s.UserID(), pd.id)
+		s.conn.Close()
+		return
+	}
+	pd.timer.Reset(pushBackoff(pd.tries))
+	s.pLock.Unlock()
+	log.Debug("session %d push %d retry %d", s.ID, pd.id, pd.tries)
+	if err := s.push(pd.m); err != nil {
+		log.Debug("session %d push %d error(%v)", s.ID, pd.id, err)
+	}
+}
+
+// ack ends the retransmission of msgID, nil when it is not pending
+// (already acked, or unknown).
+func (s *Session) ack(msgID uint64) *pending {
+	s.pLock.Lock()
+	pd, ok := s.pending[msgID]
+	if ok {
+		delete(s.pending, msgID)
+		pd.timer.Stop()
+	}
+	s.pLock.Unlock()
+	return pd
+}
+
+// closePending stops every retransmission and returns the pushes never
+// acked in the order they were sent.
+func (s *Session) closePending() []*pending {
+	s.pLock.Lock()
+	s.closed = true
+	pds := make([]*pending, 0, len(s.pending))
+	for id, pd := range s.pending {
+		pd.timer.Stop()
+		pds = append(pds, pd)
+		delete(s.pending, id)
+	}
+	s.pLock.Unlock()
+	sort.Slice(pds, func(i, j int) bool { return pds[i].id < pds[j].id })
+	return pds
+}
+
+// storePending keeps the pushes the client of s never acked offline, so
+// it gets them on its next auth. Those from offline are still stored, and
+// a push other devices of the user left unacked is stored by the first.
+func storePending(s *Session) {
+	for _, pd := range s.closePending() {
+		if pd.offlineID != 0 || s.UserID() == 0 || offline == nil {
+			continue
+		}
+		if pd.user != nil && !atomic.CompareAndSwapInt32(&pd.user.stored, 0, 1) {
+			continue
+		}
+		if err := offline.Store([]uint32{s.UserID()}, pd.cmd, withMsgID(pd.body, 0)); err != nil {
+			log.Error("user %d offline.Store() error(%v)", s.UserID(), err)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"go-test/proto"
+
+	log "github.com/thinkboy/log4go"
+)
+
+const (
+	epollEvents = 128 // events taken per epoll_wait
+
+	// one shot: a readable connection is off the loop until its packets are
+	// handled, so one goroutine at a time reads it.
+	epollRead = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+)
+
+var (
+	protoPool = sync.Pool{New: func() interface{} { return new(proto.Proto) }}
+)
+
+// reactor serves connections from epoll event loops instead of a read
+// goroutine each: a goroutine is only started when a connection turns
+// readable and ends once its buffered packets are handled. Reads and
+// writes still go through the net.Conn, epoll just tells when to read.
+type reactor struct {
+	loops []*eventLoop
+	next  uint64
+}
+
+type eventLoop struct {
+	epfd  int
+	lock  sync.Mutex
+	conns map[int]*reactorConn
+}
+
+// reactorConn is the conn of a lazy session, Close takes it off its loop
+// and ends the session whoever closes it: the reader, the writer or the
+// timers. While a reader handles its packets the reader ends it, a session
+// must not go while a handler still binds it.
+type reactorConn struct {
+	net.Conn
+	loop       *eventLoop
+	fd         int
+	s          *Session
+	closed     bool // loop.lock held
+	reading    bool // loop.lock held, a readable goroutine runs
+	closeOnce  sync.Once
+	finishOnce sync.Once
+}
+
+func newReactor(n int) (*reactor, error) {
+	r := &reactor{loops: make([]*eventLoop, n)}
+	for i := range r.loops {
+		epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+		if err != nil {
+			for _, l := range r.loops[:i] {
+				syscall.Close(l.epfd)
+			}
+			return nil, err
+		}
+		r.loops[i] = &eventLoop{epfd: epfd, conns: make(map[int]*reactorConn)}
+	}
+	for _, l := range r.loops {
+		go l.run()
+	}
+	return r, nil
+}
+
+// serve adds conn to the next loop.
+func (r *reactor) serve(conn *net.TCPConn) {
+	fd, err := connFd(conn)
+	if err != nil {
+		log.Error("connFd() error(%v)", err)
+		conn.Close()
+		return
+	}
+	l := r.loops[atomic.AddUint64(&r.next, 1)%uint64(len(r.loops))]
+	rc := &reactorConn{Conn: conn, loop: l, fd: fd}
+	rc.s = openSession(rc, true)
+	if err = l.add(rc); err != nil {
+		log.Error("epoll add fd %d error(%v)", fd, err)
+		rc.Close()
+	}
+}
+
+// connFd is the descriptor of conn, valid as long as conn is open.
+func connFd(conn *net.TCPConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	fd := -1
+	if err = raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return 0, err
+	}
+	return fd, nil
+}
+
+func (l *eventLoop) add(rc *reactorConn) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.conns[rc.fd] = rc
+	ev := syscall.EpollEvent{Events: epollRead, Fd: int32(rc.fd)}
+	if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, rc.fd, &ev); err != nil {
+		delete(l.conns, rc.fd)
+		return err
+	}
+	return nil
+}
+
+// rearm waits for rc to turn readable again, false when Close took it off
+// the loop while it was read: the reader ends the session then.
+func (l *eventLoop) rearm(rc *reactorConn) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	rc.reading = false
+	if rc.closed {
+		return false
+	}
+	ev := syscall.EpollEvent{Events: epollRead, Fd: int32(rc.fd)}
+	if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_MOD, rc.fd, &ev); err != nil {
+		log.Error("epoll rearm fd %d error(%v)", rc.fd, err)
+		go rc.Close()
+	}
+	return true
+}
+
+// del takes rc off the loop before its fd is closed and may be reused,
+// reading tells whether a reader still handles its packets.
+func (l *eventLoop) del(rc *reactorConn) (reading bool) {
+	l.lock.Lock()
+	rc.closed = true
+	if l.conns[rc.fd] == rc {
+		delete(l.conns, rc.fd)
+		syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, rc.fd, nil)
+	}
+	reading = rc.reading
+	l.lock.Unlock()
+	return
+}
+
+func (l *eventLoop) run() {
+	events := make([]syscall.EpollEvent, epollEvents)
+	for {
+		n, err := syscall.EpollWait(l.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			log.Error("epoll_wait() error(%v)", err)
+			return
+		}
+		for i := 0; i < n; i++ {
+			// an event may outlive its conn and find the next one on the same
+			// fd, a needless read of that one just waits for data.
+			l.lock.Lock()
+			rc := l.conns[int(events[i].Fd)]
+			if rc != nil {
+				rc.reading = true
+			}
+			l.lock.Unlock()
+			if rc != nil {
+				// hang ups are read too, the read sees the EOF after the data.
+				go rc.readable()
+			}
+		}
+	}
+}
+
+// readable handles the packets rc has, the read buffers go back once they
+// are all handled.
+func (rc *reactorConn) readable() {
+	s := rc.s
+	p := protoPool.Get().(*proto.Proto)
+	defer func() {
+		p.Release()
+		protoPool.Put(p)
+	}()
+	for {
+		if err := s.dec.Decode(p); err != nil {
+			readError(s, err)
+			rc.finish()
+			return
+		}
+		if err := handleProto(s, p); err != nil {
+			rc.finish()
+			return
+		}
+		if s.rd.Buffered() == 0 {
+			break
+		}
+	}
+	s.rd.release()
+	s.dec.Release()
+	if !rc.loop.rearm(rc) {
+		rc.finishClosed()
+	}
+}
+
+// finish ends the session once, it writes out its queue and closes rc.
+func (rc *reactorConn) finish() {
+	rc.finishOnce.Do(func() { closeSession(rc.s) })
+}
+
+// finishClosed ends the session of a conn Close took off the loop, no read
+// reports why the timers or the writer closed it.
+func (rc *reactorConn) finishClosed() {
+	if atomic.LoadInt32(&rc.s.evicted) != 0 {
+		readError(rc.s, nil)
+	}
+	rc.finish()
+}
+
+func (rc *reactorConn) Close() error {
+	var err error
+	rc.closeOnce.Do(func() {
+		reading := rc.loop.del(rc)
+		err = rc.Conn.Close()
+		if !reading {
+			go rc.finishClosed()
+		}
+	})
+	return err
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var (
+	ErrEpoll = errors.New("net.mode epoll is linux only")
+)
+
+type reactor struct{}
+
+func newReactor(n int) (*reactor, error) {
+	return nil, ErrEpoll
+}
+
+func (r *reactor) serve(conn *net.TCPConn) {
+	go tcpPipe(conn)
+}
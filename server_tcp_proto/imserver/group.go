@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"go-test/proto"
+
+	"github.com/gomodule/redigo/redis"
+	log "github.com/thinkboy/log4go"
+)
+
+const (
+	// members are scanned and pushed groupBatch at a time, big groups never
+	// sit in memory at once.
+	groupBatch = 512
+)
+
+var (
+	groups *Groups
+
+	ErrGroupExists   = errors.New("group already exists")
+	ErrGroupNotFound = errors.New("group does not exist")
+	ErrGroupDisabled = errors.New("groups need redis, see redis.addr")
+)
+
+// groupKey is a hash of member user ID -> role.
+func groupKey(groupID uint32) string {
+	return fmt.Sprintf("group:%d", groupID)
+}
+
+// createScript creates the group only when the key is not there yet.
+var createScript = redis.NewScript(1, `
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[1], ARGV[2])
+return 1`)
+
+// joinScript adds a member only to a group that exists, a missing key
+// would otherwise become a group without owner.
+var joinScript = redis.NewScript(1, `
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+redis.call("HSETNX", KEYS[1], ARGV[1], ARGV[2])
+return 1`)
+
+// Groups stores group members and their roles in redis.
+type Groups struct {
+	pool *redis.Pool
+}
+
+func NewGroups(pool *redis.Pool) *Groups {
+	return &Groups{pool: pool}
+}
+
+// Create makes owner the owner of a new group.
+func (g *Groups) Create(groupID, owner uint32) error {
+	conn := g.pool.Get()
+	defer conn.Close()
+	ok, err := redis.Bool(createScript.Do(conn, groupKey(groupID), owner, proto.GROUP_ROLE_OWNER))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrGroupExists
+	}
+	return nil
+}
+
+// Role of userID in the group, 0 when not a member.
+func (g *Groups) Role(groupID, userID uint32) (uint32, error) {
+	conn := g.pool.Get()
+	defer conn.Close()
+	role, err := redis.Uint64(conn.Do("HGET", groupKey(groupID), userID))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return uint32(role), err
+}
+
+// Join adds userID as a member of an existing group, a member keeps the
+// role it has.
+func (g *Groups) Join(groupID, userID uint32) error {
+	conn := g.pool.Get()
+	defer conn.Close()
+	ok, err := redis.Bool(joinScript.Do(conn, groupKey(groupID), userID, proto.GROUP_ROLE_MEMBER))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrGroupNotFound
+	}
+	return nil
+}
+
+func (g *Groups) SetRole(groupID, userID, role uint32) error {
+	conn := g.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("HSET", groupKey(groupID), userID, role)
+	return err
+}
+
+func (g *Groups) Remove(groupID, userID uint32) error {
+	conn := g.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("HDEL", groupKey(groupID), userID)
+	return err
+}
+
+// Scan calls fn with the members (user ID -> role) of the group, about
+// batch at a time. No connection is held while fn runs, fn may use the pool.
+func (g *Groups) Scan(groupID uint32, batch int, fn func(members map[uint32]uint32)) error {
+	key, cursor := groupKey(groupID), int64(0)
+	for {
+		conn := g.pool.Get()
+		vs, err := redis.Values(conn.Do("HSCAN", key, cursor, "COUNT", batch))
+		conn.Close()
+		if err != nil {
+			return err
+		}
+		if cursor, err = redis.Int64(vs[0], nil); err != nil {
+			return err
+		}
+		kvs, err := redis.Strings(vs[1], nil)
+		if err != nil {
+			return err
+		}
+		members := make(map[uint32]uint32, len(kvs)/2)
+		for i := 0; i+1 < len(kvs); i += 2 {
+			userID, err1 := strconv.ParseUint(kvs[i], 10, 32)
+			role, err2 := strconv.ParseUint(kvs[i+1], 10, 32)
+			if err1 != nil || err2 != nil {
+				log.Warn("group %d bad member %q role %q", groupID, kvs[i], kvs[i+1])
+				continue
+			}
+			members[uint32(userID)] = uint32(role)
+		}
+		if len(members) > 0 {
+			fn(members)
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// Fanout delivers body as cmd to the members with role (every member for
+// role 0) except userID wherever they are online, and stores it for the
+// offline ones. Returns how many sessions here and members on other nodes
+// got it.
+func (g *Groups) Fanout(groupID, role, userID uint32, cmd int32, body interface{}) (n int, err error) {
+	err = g.Scan(groupID, groupBatch, func(members map[uint32]uint32) {
+		var memberIDs []uint32
+		for memberID, r := range members {
+			if memberID == userID || (role != 0 && r != role) {
+				continue
+			}
+			memberIDs = append(memberIDs, memberID)
+		}
+		if len(memberIDs) == 0 {
+			return
+		}
+		k, err := deliverUsers(memberIDs, cmd, body)
+		if err != nil {
+			log.Error("group %d offline.Store() error(%v)", groupID, err)
+		}
+		n += k
+	})
+	return
+}
+
+func validRole(role uint32) bool {
+	return role >= proto.GROUP_ROLE_OWNER && role <= proto.GROUP_ROLE_MEMBER
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"time"
+
+	"go-test/proto"
+
+	log "github.com/thinkboy/log4go"
+)
+
+var (
+	router  = NewRouter()
+	metrics = NewMetrics()
+)
+
+func initRouter() {
+	router.Use(Recovery, Logging, metrics.Middleware, Auth(requireAuth))
+	go metrics.Report(time.Minute)
+
+	router.Handle(proto.OP_AUTH, proto.OP_AUTH_REPLY, newReqAuth, auth)
+	router.Handle(CMD_REQ_NOTICE_FRIEND, CMD_ACK_NOTICE_FRIEND, newReqNoticeFriend, noticeFriend)
+	router.Handle(CMD_REQ_NOTICE_RELAY_SERVER, CMD_ACK_NOTICE_RELAY_SERVER, newReqNoticeFriend, noticeRelayServer)
+	router.Handle(CMD_REQ_NOTICE_GROUP, CMD_ACK_NOTICE_GROUP, newReqNoticeGroup, noticeGroup)
+	router.Handle(CMD_REQ_NOTICE_GROUP_ROLE, CMD_ACK_NOTICE_GROUP_ROLE, newReqNoticeGroup, noticeGroupRole)
+	router.Handle(CMD_REQ_PUSH_ACK, CMD_ACK_PUSH_ACK, newReqPushAck, pushAck)
+	router.Handle(CMD_REQ_GROUP_CREATE, CMD_ACK_GROUP_CREATE, newReqGroup, groupCreate)
+	router.Handle(CMD_REQ_GROUP_JOIN, CMD_ACK_GROUP_JOIN, newReqGroup, groupJoin)
+	router.Handle(CMD_REQ_GROUP_QUIT, CMD_ACK_GROUP_QUIT, newReqGroup, groupQuit)
+	router.Handle(CMD_REQ_GROUP_SET_ROLE, CMD_ACK_GROUP_SET_ROLE, newReqGroup, groupSetRole)
+}
+
+func newReqAuth() interface{} {
+	return new(proto.ReqAuth)
+}
+
+func newReqNoticeFriend() interface{} {
+	return new(proto.ReqNoticeFriend)
+}
+
+func newReqNoticeGroup() interface{} {
+	return new(proto.ReqNoticeGroup)
+}
+
+func newReqPushAck() interface{} {
+	return new(proto.ReqPushAck)
+}
+
+func newReqGroup() interface{} {
+	return new(proto.ReqGroup)
+}
+
+var (
+	errNotMember = &CodeError{Code: proto.CODE_DENIED, Info: "not a group member"}
+	errRole      = &CodeError{Code: proto.CODE_DENIED, Info: "role not allowed"}
+)
+
+// groupRole is the role of the session user in groupID, groups act on
+// the authenticated user only.
+func groupRole(c *Context, groupID uint32) (uint32, error) {
+	if groups == nil {
+		return 0, ErrGroupDisabled
+	}
+	role, err := groups.Role(groupID, c.Session.UserID())
+	if err != nil {
+		return 0, err
+	}
+	if role == 0 {
+		return 0, errNotMember
+	}
+	return role, nil
+}
+
+// auth checks the credentials with the authenticator and binds the
+// session to its user, so pushes can find it.
+func auth(c *Context, req interface{}) (interface{}, error) {
+	r := req.(*proto.ReqAuth)
+	if c.Session.UserID() != 0 {
+		return nil, &CodeError{Code: proto.CODE_FAILED, Info: "already authenticated"}
+	}
+	userID, err := authenticator.Auth(r)
+	if err != nil {
+		log.Warn("session %d %s auth user %d error(%v)", c.Session.ID, c.Session.RemoteAddr(), r.UserID, err)
+		return nil, &CodeError{Code: proto.CODE_NOT_AUTHED, Info: "auth failed"}
+	}
+	if userID == 0 {
+		return nil, &CodeError{Code: proto.CODE_BAD_BODY, Info: "no user id"}
+	}
+	r.UserID = userID
+	sessions.Bind(c.Session, r.UserID)
+	c.Session.authTimer.Stop()
+	log.Debug("session %d auth user %d device %s", c.Session.ID, r.UserID, r.Device)
+	// before the offline messages: what is pushed from now on finds it.
+	if cluster != nil {
+		if err = cluster.Register(r.UserID); err != nil {
+			log.Error("user %d cluster.Register() error(%v)", r.UserID, err)
+		}
+	}
+	if offline != nil {
+		s := c.Session
+		c.AfterAck(func() { goRequest(func() { deliverOffline(s) }) })
+	}
+	return &proto.AckNotice{Code: proto.CODE_OK, Info: "ok"}, nil
+}
+
+// noticeFriend delivers the notice to every session of ObjectID, from the
+// session user whatever UserID the client put in. A user can not notice
+// itself, its other devices would get the push as from a friend.
+func noticeFriend(c *Context, req interface{}) (interface{}, error) {
+	r := req.(*proto.ReqNoticeFriend)
+	r.UserID = c.Session.UserID()
+	if r.ObjectID == 0 {
+		return nil, &CodeError{Code: proto.CODE_BAD_BODY, Info: "no object id"}
+	}
+	if r.ObjectID == r.UserID {
+		return nil, &CodeError{Code: proto.CODE_BAD_BODY, Info: "can not notice yourself"}
+	}
+	log.Debug("friend notice %d -> %d", r.UserID, r.ObjectID)
+	info := "ok"
+	n, err := deliverUsers([]uint32{r.ObjectID}, CMD_PUSH_NOTICE_FRIEND, r)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		info = "offline"
+	}
+	return &proto.AckNotice{Code: proto.CODE_OK, Info: info, MsgFlag: r.MsgFlag}, nil
+}
+
+// deliverOffline runs once the auth ack is queued, the messages are delivered like
+// live pushes and dropped from redis by pushAck.
+func deliverOffline(s *Session) {
+	n, err := offline.Deliver(s)
+	if err != nil {
+		log.Error("user %d offline.Deliver() error(%v)", s.UserID(), err)
+	}
+	if n > 0 {
+		log.Debug("user %d session %d %d offline messages", s.UserID(), s.ID, n)
+	}
+}
+
+// pushAck ends the retransmission of a push, and drops it from redis when
+// it came from there. Acks of pushes no longer pending are ok, the first
+// ack may have been slower than a retry.
+func pushAck(c *Context, req interface{}) (interface{}, error) {
+	r := req.(*proto.ReqPushAck)
+	pd := c.Session.ack(r.MsgID)
+	if pd != nil && pd.offlineID != 0 && offline != nil {
+		if err := offline.Ack(c.Session.UserID(), pd.offlineID); err != nil {
+			return nil, err
+		}
+	}
+	return &proto.AckNotice{Code: proto.CODE_OK, Info: "ok"}, nil
+}
+
+func noticeRelayServer(c *Context, req interface{}) (interface{}, error) {
+	r := req.(*proto.ReqNoticeFriend)
+	log.Debug("relay server notice %d -> %d", r.UserID, r.ObjectID)
+	return &proto.AckNotice{Code: proto.CODE_OK, Info: "ok", MsgFlag: r.MsgFlag}, nil
+}
+
+// noticeGroup fans the notice out to every online member, owner and
+// admins only.
+func noticeGroup(c *Context, req interface{}) (interface{}, error) {
+	r := req.(*proto.ReqNoticeGroup)
+	r.Role = 0
+	return fanoutGroup(c, r)
+}
+
+// noticeGroupRole fans the notice out to the online members with r.Role,
+// owner and admins only.
+func noticeGroupRole(c *Context, req interface{}) (interface{}, error) {
+	r := req.(*proto.ReqNoticeGroup)
+	if !validRole(r.Role) {
+		return nil, &CodeError{Code: proto.CODE_BAD_BODY, Info: "bad role"}
+	}
+	return fanoutGroup(c, r)
+}
+
+// fanoutGroup checks the sender and pushes in the background, a big group
+// must not hold up the sender's next request.
+func fanoutGroup(c *Context, r *proto.ReqNoticeGroup) (interface{}, error) {
+	role, err := groupRole(c, r.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	if role > proto.GROUP_ROLE_ADMIN {
+		return nil, errRole
+	}
+	r.UserID = c.Session.UserID()
+	goRequest(func() {
+		n, err := groups.Fanout(r.GroupID, r.Role, r.UserID, CMD_PUSH_NOTICE_GROUP, r)
+		if err != nil {
+			log.Error("group %d fanout error(%v)", r.GroupID, err)
+		}
+		log.Debug("group notice %d -> group %d role %d, %d sessions", r.UserID, r.GroupID, r.Role, n)
+	})
+	return &proto.AckNotice{Code: proto.CODE_OK, Info: "ok", MsgFlag: r.MsgFlag}, nil
+}
+
+// groupCreate makes the session user owner of a new group.
+func groupCreate(c *Context, req interface{}) (interface{}, error) {
+	r := req.(*proto.ReqGroup)
+	if groups == nil {
+		return nil, ErrGroupDisabled
+	}
+	if err := groups.Create(r.GroupID, c.Session.UserID()); err != nil {
+		return nil, err
+	}
+	return &proto.AckNotice{Code: proto.CODE_OK, Info: "ok"}, nil
+}
+
+func groupJoin(c *Context, req interface{}) (interface{}, error) {
+	r := req.(*proto.ReqGroup)
+	if _, err := groupRole(c, r.GroupID); err != errNotMember {
+		if err == nil {
+			err = &CodeError{Code: proto.CODE_FAILED, Info: "already a member"}
+		}
+		return nil, err
+	}
+	if err := groups.Join(r.GroupID, c.Session.UserID()); err != nil {
+		return nil, err
+	}
+	return &proto.AckNotice{Code: proto.CODE_OK, Info: "ok"}, nil
+}
+
+// groupQuit the owner can not quit its group.
+func groupQuit(c *Context, req interface{}) (interface{}, error) {
+	r := req.(*proto.ReqGroup)
+	role, err := groupRole(c, r.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	if role == proto.GROUP_ROLE_OWNER {
+		return nil, errRole
+	}
+	if err = groups.Remove(r.GroupID, c.Session.UserID()); err != nil {
+		return nil, err
+	}
+	return &proto.AckNotice{Code: proto.CODE_OK, Info: "ok"}, nil
+}
+
+// groupSetRole changes the role of r.MemberID, or removes it for role 0.
+// Both the member and its new role must rank below the session user, so
+// the owner manages admins and members, admins remove members.
+func groupSetRole(c *Context, req interface{}) (interface{}, error) {
+	r := req.(*proto.ReqGroup)
+	if r.Role != 0 && !validRole(r.Role) {
+		return nil, &CodeError{Code: proto.CODE_BAD_BODY, Info: "bad role"}
+	}
+	role, err := groupRole(c, r.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	memberRole, err := groups.Role(r.GroupID, r.MemberID)
+	if err != nil {
+		return nil, err
+	}
+	if memberRole == 0 {
+		return nil, errNotMember
+	}
+	if memberRole <= role || (r.Role != 0 && r.Role <= role) {
+		return nil, errRole
+	}
+	if r.Role == 0 {
+		err = groups.Remove(r.GroupID, r.MemberID)
+	} else {
+		err = groups.SetRole(r.GroupID, r.MemberID, r.Role)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("group %d user %d set %d role %d", r.GroupID, c.Session.UserID(), r.MemberID, r.Role)
+	return &proto.AckNotice{Code: proto.CODE_OK, Info: "ok"}, nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"go-test/proto"
+)
+
+// refreshIdle gives the client another heartbeat.timeout to send its next
+// frame, any frame counts, not only heartbeats.
+func refreshIdle(s *Session) {
+	s.idleTimer.Reset(Conf.HeartbeatTimeout)
+}
+
+// heartbeat replies OP_HEARTBEAT_REPLY with the SeqId of the request.
+func heartbeat(s *Session, p *proto.Proto) error {
+	p.Cmd = proto.OP_HEARTBEAT_REPLY
+	p.Body = nil
+	return s.Push(p)
+}
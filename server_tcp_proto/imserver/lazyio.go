@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// epoll mode sessions only hold read and write buffers while they read a
+// packet or write their queue, idle ones share none.
+var (
+	readerPool = sync.Pool{New: func() interface{} { return bufio.NewReader(nil) }}
+	writerPool = sync.Pool{New: func() interface{} { return bufio.NewWriter(nil) }}
+)
+
+// flushWriter is the buffered writer under the encoder.
+type flushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// lazyReader takes a pooled bufio.Reader on the first Read, release gives
+// it back once nothing is buffered.
+type lazyReader struct {
+	rd io.Reader
+	br *bufio.Reader
+}
+
+func (r *lazyReader) Read(b []byte) (int, error) {
+	if r.br == nil {
+		r.br = readerPool.Get().(*bufio.Reader)
+		r.br.Reset(r.rd)
+	}
+	return r.br.Read(b)
+}
+
+// Buffered is how many bytes were read ahead of the last packet.
+func (r *lazyReader) Buffered() int {
+	if r.br == nil {
+		return 0
+	}
+	return r.br.Buffered()
+}
+
+func (r *lazyReader) release() {
+	if r.br == nil || r.br.Buffered() > 0 {
+		return
+	}
+	r.br.Reset(nil)
+	readerPool.Put(r.br)
+	r.br = nil
+}
+
+// lazyWriter takes a pooled bufio.Writer on the first Write, Flush gives it
+// back, also when the write failed: the connection is done then.
+type lazyWriter struct {
+	wr io.Writer
+	bw *bufio.Writer
+}
+
+func (w *lazyWriter) Write(b []byte) (int, error) {
+	if w.bw == nil {
+		w.bw = writerPool.Get().(*bufio.Writer)
+		w.bw.Reset(w.wr)
+	}
+	return w.bw.Write(b)
+}
+
+func (w *lazyWriter) Flush() error {
+	if w.bw == nil {
+		return nil
+	}
+	err := w.bw.Flush()
+	w.bw.Reset(nil)
+	writerPool.Put(w.bw)
+	w.bw = nil
+	return err
+}
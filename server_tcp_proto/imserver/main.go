@@ -1,10 +1,16 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
-	"fmt"
+	"flag"
 	"net"
+	"os"
+	"runtime"
+	"sync/atomic"
+
+	"go-test/common"
+	"go-test/proto"
+
+	log "github.com/thinkboy/log4go"
 )
 
 const (
@@ -17,108 +23,230 @@ const (
 	CMD_REQ_NOTICE_GROUP_ROLE = int32(1005)
 	CMD_ACK_NOTICE_GROUP_ROLE = int32(1006)
 
+	CMD_REQ_GROUP_CREATE = int32(1007)
+	CMD_ACK_GROUP_CREATE = int32(1008)
+
+	CMD_REQ_GROUP_JOIN = int32(1009)
+	CMD_ACK_GROUP_JOIN = int32(1010)
+
+	CMD_REQ_GROUP_QUIT = int32(1011)
+	CMD_ACK_GROUP_QUIT = int32(1012)
+
+	CMD_REQ_GROUP_SET_ROLE = int32(1013)
+	CMD_ACK_GROUP_SET_ROLE = int32(1014)
+
+	CMD_REQ_PUSH_ACK = int32(1015)
+	CMD_ACK_PUSH_ACK = int32(1016)
+
 	CMD_REQ_NOTICE_RELAY_SERVER = int32(4109)
 	CMD_ACK_NOTICE_RELAY_SERVER = int32(4110)
-)
-
-type AckNotice struct {
-	Code    int    `json:"code"`
-	Info    string `json:"info"`
-	MsgFlag string `json:"msg_flag"`
-}
 
-const (
-	strLocalAddr = "127.0.0.1:8080"
+	// server pushes, SeqId 0, the body is the notice request.
+	CMD_PUSH_NOTICE_FRIEND = int32(2001)
+	CMD_PUSH_NOTICE_GROUP  = int32(2003)
 )
 
 func main() {
-	fmt.Println("begin......, server =", strLocalAddr)
+	flag.Parse()
+	if err := InitConfig(); err != nil {
+		log.Error("InitConfig(\"%s\") error(%v)", confFile, err)
+		log.Close()
+		os.Exit(1)
+	}
+	runtime.GOMAXPROCS(Conf.MaxProc)
+	log.LoadConfiguration(Conf.Log)
+	defer log.Close()
+	log.Info("begin......, server = %v", Conf.TCPAddr)
+	if err := writePidFile(); err != nil {
+		log.Error("writePidFile(\"%s\") error(%v)", Conf.PidFile, err)
+		return
+	}
+	defer removePidFile()
+	if err := initCrypto(); err != nil {
+		log.Error("initCrypto() error(%v)", err)
+		return
+	}
+	initTimers()
+	initRedis()
+	initCluster()
+	initAuth()
+	initRouter()
+	if err := initNet(); err != nil {
+		log.Error("initNet() error(%v)", err)
+		return
+	}
+	if err := initTLS(); err != nil {
+		log.Error("initTLS() error(%v)", err)
+		return
+	}
+	if err := initWebsocket(); err != nil {
+		log.Error("initWebsocket() error(%v)", err)
+		return
+	}
+	if err := initTCP(); err != nil {
+		log.Error("initTCP() error(%v)", err)
+		return
+	}
 
-	var pTcpAddr *net.TCPAddr
-	pTcpAddr, _ = net.ResolveTCPAddr("tcp", strLocalAddr)
-	pTcpListerner, _ := net.ListenTCP("tcp", pTcpAddr)
+	common.InitSignal()
+	shutdown()
+	log.Info("end.....")
+}
 
-	defer pTcpListerner.Close()
+// initTCP listens on every tcp.addr.
+func initTCP() error {
+	for _, addr := range Conf.TCPAddr {
+		pTcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			return err
+		}
+		pTcpListerner, err := net.ListenTCP("tcp", pTcpAddr)
+		if err != nil {
+			return err
+		}
+		log.Info("tcp server = %s", addr)
+		addCloser(pTcpListerner)
+		go acceptTCP(pTcpListerner)
+	}
+	return nil
+}
 
+func acceptTCP(pTcpListerner *net.TCPListener) {
 	for {
 		pTcpConn, err := pTcpListerner.AcceptTCP()
 		if err != nil {
+			if shuttingDown() {
+				return
+			}
 			continue
 		}
+		if !admit(pTcpConn) {
+			continue
+		}
+		tune(pTcpConn)
 
-		fmt.Println("a client connect: " + pTcpConn.RemoteAddr().String())
-		go tcpPipe(pTcpConn)
+		log.Debug("a client connect: %s", pTcpConn.RemoteAddr().String())
+		serveTCP(pTcpConn)
 	}
+}
 
-	fmt.Println("end.....\n")
+// admit closes conn when maxconn connections are open already.
+func admit(conn net.Conn) bool {
+	if Conf.MaxConn > 0 && atomic.LoadInt64(&pipes) >= int64(Conf.MaxConn) {
+		log.Warn("maxconn %d reached, refuse %s", Conf.MaxConn, conn.RemoteAddr().String())
+		conn.Close()
+		return false
+	}
+	return true
 }
 
-func tcpPipe(pConn *net.TCPConn) {
-	strRemoteAddr := pConn.RemoteAddr().String()
-	defer func() {
-		fmt.Println("disconnect :" + strRemoteAddr)
-		pConn.Close()
-	}()
+func tcpPipe(pConn net.Conn) {
+	s := openSession(pConn, false)
+	defer closeSession(s)
 
 	var err error
-	proto := new(Proto)
-	pReader := bufio.NewReader(pConn)
-	pWriter := bufio.NewWriter(pConn)
+	p := new(proto.Proto)
+	defer p.Release()
 
 	for {
-		if err = tcpReadProto(pReader, proto); err != nil {
-			fmt.Println(err)
+		if err = s.dec.Decode(p); err != nil {
+			readError(s, err)
+			return
+		}
+		if err = handleProto(s, p); err != nil {
 			return
 		}
-		fmt.Println(string(proto.Body))
+	}
+}
 
-		/*
-			dst := new(bytes.Buffer)
-			json.Indent(dst, proto.Body, "", "    ")
-			fmt.Println(dst)
-		*/
+// openSession registers a new connection, lazy sessions hold no buffers
+// and no goroutines while idle.
+func openSession(conn net.Conn, lazy bool) *Session {
+	atomic.AddInt64(&pipes, 1)
+	s := NewSession(conn, lazy)
+	sessions.Add(s)
+	s.startTimers()
+	return s
+}
 
-		pProtoWrite := new(Proto)
-		pProtoWrite.Ver = proto.Ver
-		pProtoWrite.SeqId = proto.SeqId
-		Dispatch(pWriter, pProtoWrite)
+func closeSession(s *Session) {
+	log.Debug("disconnect: %s session: %d user: %d", s.RemoteAddr(), s.ID, s.UserID())
+	s.stopTimers()
+	sessions.Remove(s)
+	if cluster != nil && s.UserID() != 0 {
+		if err := cluster.Unregister(s.UserID()); err != nil {
+			log.Error("user %d cluster.Unregister() error(%v)", s.UserID(), err)
+		}
 	}
+	s.Close()
+	storePending(s)
+	atomic.AddInt64(&pipes, -1)
 }
 
-func Dispatch(w *bufio.Writer, p *Proto) (err error) {
-	if p.Cmd == CMD_REQ_NOTICE_FRIEND {
-		fmt.Println("friend notice-------")
+// readError logs why reading s failed.
+func readError(s *Session, err error) {
+	switch atomic.LoadInt32(&s.evicted) {
+	case evictIdle:
+		log.Info("session %d user %d idle for %v, evicted", s.ID, s.UserID(), Conf.HeartbeatTimeout)
+	case evictAuth:
+		log.Info("session %d not authenticated in %v, evicted", s.ID, Conf.HandshakeTimeout)
+	case evictSlow:
+		log.Info("session %d user %d too slow, write queue full, evicted", s.ID, s.UserID())
+	default:
+		log.Debug("dec.Decode() error(%v)", err)
+	}
+}
 
-		p.Cmd = CMD_ACK_NOTICE_FRIEND
-		oAckRlatUser := AckNotice{0, "ok", "friend notice"}
-		SendAck(w, p, oAckRlatUser)
-	} else if p.Cmd == CMD_REQ_NOTICE_RELAY_SERVER {
-		fmt.Println("relay server notice-------")
+// handleProto handles one packet read from s, an error ends the connection.
+func handleProto(s *Session, p *proto.Proto) (err error) {
+	refreshIdle(s)
+	s.follow(p.Ver)
+	if p.Cmd == proto.OP_HANDSHARE {
+		if err = handshake(s, p); err != nil {
+			log.Error("handshake() error(%v)", err)
+		}
+		return
+	}
+	if Conf.RequireHandshake && !s.encrypted {
+		log.Info("session %d sent cmd %d before the handshake, closed", s.ID, p.Cmd)
+		return ErrHandshakeRequired
+	}
+	switch p.Cmd {
+	case proto.OP_HEARTBEAT:
+		if err = heartbeat(s, p); err != nil {
+			log.Error("heartbeat() error(%v)", err)
+		}
+		return
+	}
+	log.Finest("read proto: %s", p)
 
-		p.Cmd = CMD_ACK_NOTICE_RELAY_SERVER
-		oAckRlatUser := AckNotice{0, "ok", "relay"}
-		SendAck(w, p, oAckRlatUser)
-	} else if p.Cmd == CMD_REQ_NOTICE_GROUP {
-		fmt.Println("group notice-------")
+	/*
+		dst := new(bytes.Buffer)
+		json.Indent(dst, p.Body, "", "    ")
+		log.Finest(dst)
+	*/
 
-		p.Cmd = CMD_ACK_NOTICE_GROUP
-		oAckRlatUser := AckNotice{0, "ok", "group notice"}
-		SendAck(w, p, oAckRlatUser)
+	if !beginRequest() {
+		return
+	}
+	err = router.Dispatch(s, p)
+	endRequest()
+	if err != nil {
+		log.Error("router.Dispatch() error(%v)", err)
 	}
-
 	return
 }
 
-func SendAck(wr *bufio.Writer, p *Proto, oObj interface{}) (err error) {
-	fmt.Println("tcpSendAck()")
-
-	if p.Body, err = json.Marshal(oObj); err != nil {
-		fmt.Println(err)
-		p.Body = []byte("{}")
+func SendAck(s *Session, p *proto.Proto, oObj interface{}) (err error) {
+	if oObj == nil {
+		p.Body = nil
+	} else if err = p.SetBody(oObj); err != nil {
+		log.Error("p.SetBody() error(%v)", err)
+		p.Body = nil
 	}
 
-	if err = tcpWriteProto(wr, p); err != nil {
-		fmt.Println("tcpSendAck() error ", err)
+	if err = s.Push(p); err != nil {
+		log.Error("s.Push() error(%v)", err)
 		return
 	}
 	return
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-test/common/sockopt"
+	"go-test/proto"
+
+	log "github.com/thinkboy/log4go"
+)
+
+// Middleware wraps a handler, see Router.Use.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Recovery turns a handler panic into a proto.CODE_FAILED ack instead of
+// killing the connection.
+func Recovery(next HandlerFunc) HandlerFunc {
+	return func(c *Context, req interface{}) (ack interface{}, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Error("cmd %d seq %d panic(%v)\n%s", c.Req.Cmd, c.Req.SeqId, r, debug.Stack())
+				ack, err = nil, &CodeError{Code: proto.CODE_FAILED, Info: "internal error"}
+			}
+		}()
+		return next(c, req)
+	}
+}
+
+// Logging logs every request with its cost and result.
+func Logging(next HandlerFunc) HandlerFunc {
+	return func(c *Context, req interface{}) (interface{}, error) {
+		start := time.Now()
+		ack, err := next(c, req)
+		if err != nil {
+			log.Warn("cmd: %d seq: %d ver: %d req: %+v cost: %v error(%v)", c.Req.Cmd, c.Req.SeqId, c.Req.Ver, req, time.Since(start), err)
+		} else {
+			log.Debug("cmd: %d seq: %d ver: %d req: %+v cost: %v ack: %+v", c.Req.Cmd, c.Req.SeqId, c.Req.Ver, req, time.Since(start), ack)
+		}
+		return ack, err
+	}
+}
+
+// CmdStat is the latency summary of one cmd.
+type CmdStat struct {
+	Cmd    int32
+	Count  int64
+	Errors int64
+	Total  time.Duration
+	Max    time.Duration
+}
+
+func (s CmdStat) Avg() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count)
+}
+
+// Metrics counts calls, errors and latency per cmd.
+type Metrics struct {
+	lock  sync.Mutex
+	stats map[int32]*CmdStat
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{stats: make(map[int32]*CmdStat)}
+}
+
+func (m *Metrics) Observe(cmd int32, cost time.Duration, failed bool) {
+	m.lock.Lock()
+	s, ok := m.stats[cmd]
+	if !ok {
+		s = &CmdStat{Cmd: cmd}
+		m.stats[cmd] = s
+	}
+	s.Count++
+	if failed {
+		s.Errors++
+	}
+	s.Total += cost
+	if cost > s.Max {
+		s.Max = cost
+	}
+	m.lock.Unlock()
+}
+
+// Snapshot returns the stats ordered by cmd.
+func (m *Metrics) Snapshot() []CmdStat {
+	m.lock.Lock()
+	stats := make([]CmdStat, 0, len(m.stats))
+	for _, s := range m.stats {
+		stats = append(stats, *s)
+	}
+	m.lock.Unlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Cmd < stats[j].Cmd })
+	return stats
+}
+
+// Middleware observes every request of the wrapped handler.
+func (m *Metrics) Middleware(next HandlerFunc) HandlerFunc {
+	return func(c *Context, req interface{}) (interface{}, error) {
+		start := time.Now()
+		ack, err := next(c, req)
+		m.Observe(c.Req.Cmd, time.Since(start), err != nil)
+		return ack, err
+	}
+}
+
+// Report logs the stats every interval.
+func (m *Metrics) Report(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, s := range m.Snapshot() {
+			log.Info("cmd: %d count: %d errors: %d avg: %v max: %v", s.Cmd, s.Count, s.Errors, s.Avg(), s.Max)
+		}
+		log.Info("write queue dropped: %d blocked: %d evicted: %d", atomic.LoadUint64(&outDropped),
+			atomic.LoadUint64(&outBlocked), atomic.LoadUint64(&outEvicted))
+		if e, ok := lastSockOpt.Load().(*sockopt.Effective); ok {
+			log.Info("socket of the last connection %s", e)
+		}
+	}
+}
+
+// Auth rejects the request when check fails, with the CodeError check
+// returns or proto.CODE_FAILED.
+func Auth(check func(c *Context) error) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context, req interface{}) (interface{}, error) {
+			if err := check(c); err != nil {
+				return nil, err
+			}
+			return next(c, req)
+		}
+	}
+}
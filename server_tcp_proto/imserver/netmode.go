@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net"
+
+	log "github.com/thinkboy/log4go"
+)
+
+const (
+	netGoroutine = "goroutine"
+	netEpoll     = "epoll"
+)
+
+var (
+	// serveTCP serves an accepted raw tcp connection in the tcp:net.mode.
+	serveTCP = func(conn *net.TCPConn) { go tcpPipe(conn) }
+)
+
+// initNet picks how accepted raw tcp connections are served.
+func initNet() error {
+	if Conf.NetMode != netEpoll {
+		return nil
+	}
+	r, err := newReactor(Conf.EpollLoops)
+	if err != nil {
+		return err
+	}
+	serveTCP = r.serve
+	log.Info("serve tcp with %d epoll loops", Conf.EpollLoops)
+	return nil
+}
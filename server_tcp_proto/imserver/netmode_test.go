@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go-test/proto"
+
+	log "github.com/thinkboy/log4go"
+)
+
+// compares the memory per connection of net.mode goroutine and net.mode
+// epoll: open benchConns connections, send a heartbeat on each so every
+// session has read and written once, and read the growth of the heap and
+// the stacks while they idle. With push every connection also gets one
+// reply of that many bytes first, an idle session must not keep the
+// buffers of its biggest packet. The client side of each connection, a
+// few hundred bytes, is counted too.
+//
+//	go test -run none -bench IdleSession
+
+const (
+	benchConns = 1000
+	benchPush  = 32 << 10
+)
+
+var (
+	benchOnce    sync.Once
+	benchReactor *reactor
+	benchErr     error
+)
+
+func benchSetup() {
+	Conf = NewConfig()
+	Conf.AuthInsecure = true
+	// the heartbeat only connections never authenticate.
+	Conf.HandshakeTimeout = time.Hour
+	log.LoadConfiguration("testdata/log.xml")
+	initTimers()
+	initAuth()
+	initRouter()
+	benchReactor, benchErr = newReactor(1)
+}
+
+func BenchmarkIdleSession(b *testing.B) {
+	benchOnce.Do(benchSetup)
+	for _, mode := range []string{netGoroutine, netEpoll} {
+		for _, push := range []int{0, benchPush} {
+			mode, push := mode, push
+			b.Run(fmt.Sprintf("%s/push=%d", mode, push), func(b *testing.B) {
+				serve := func(conn *net.TCPConn) { go tcpPipe(conn) }
+				if mode == netEpoll {
+					if benchErr != nil {
+						b.Skip(benchErr)
+					}
+					serve = benchReactor.serve
+				}
+				benchIdle(b, serve, push)
+			})
+		}
+	}
+}
+
+func benchIdle(b *testing.B, serve func(conn *net.TCPConn), push int) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			serve(conn)
+		}
+	}()
+	addr := ln.Addr().String()
+	var grown int64
+	for i := 0; i < b.N; i++ {
+		before := memInUse()
+		conns := make([]net.Conn, 0, benchConns)
+		for j := 0; j < benchConns; j++ {
+			conn, err := benchOpen(addr, uint32(j+1), push)
+			if err != nil {
+				b.Fatalf("connection %d error(%v)", j, err)
+			}
+			conns = append(conns, conn)
+		}
+		// the epoll readers end once the replies are out.
+		time.Sleep(100 * time.Millisecond)
+		grown += memInUse() - before
+		for _, conn := range conns {
+			conn.Close()
+		}
+		if !waitZero(&pipes, time.Now().Add(5*time.Second)) {
+			b.Fatal("sessions not closed")
+		}
+	}
+	b.ReportMetric(float64(grown)/float64(b.N*benchConns), "B/conn")
+}
+
+// memInUse is the heap and the goroutine stacks in use after a gc.
+func memInUse() int64 {
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	return int64(m.HeapInuse + m.StackInuse)
+}
+
+// benchOpen connects and waits for the reply to a heartbeat, with push
+// also for a reply of push bytes to userID.
+func benchOpen(addr string, userID uint32, push int) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	enc, dec := proto.NewEncoder(conn), proto.NewDecoder(bufio.NewReader(conn))
+	if err = benchCall(enc, dec, &proto.Proto{Ver: proto.VerJSON, Cmd: proto.OP_HEARTBEAT, SeqId: 1}, proto.OP_HEARTBEAT_REPLY); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if push <= 0 {
+		return conn, nil
+	}
+	p := &proto.Proto{Ver: proto.VerJSON, Cmd: proto.OP_AUTH, SeqId: 2}
+	p.SetBody(&proto.ReqAuth{UserID: userID, Device: "benchmark"})
+	if err = benchCall(enc, dec, p, proto.OP_AUTH_REPLY); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// the relay ack echoes the MsgFlag.
+	p = &proto.Proto{Ver: proto.VerJSON, Cmd: CMD_REQ_NOTICE_RELAY_SERVER, SeqId: 3}
+	p.SetBody(&proto.ReqNoticeFriend{MsgFlag: strings.Repeat("x", push), UserID: userID, ObjectID: userID})
+	if err = benchCall(enc, dec, p, CMD_ACK_NOTICE_RELAY_SERVER); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// benchCall sends p and reads the reply, which must be cmd and ok.
+func benchCall(enc *proto.Encoder, dec *proto.Decoder, p *proto.Proto, cmd int32) error {
+	if err := enc.Encode(p); err != nil {
+		return err
+	}
+	if err := dec.Decode(p); err != nil {
+		return err
+	}
+	if p.Cmd != cmd {
+		return fmt.Errorf("unexpected cmd %d", p.Cmd)
+	}
+	if len(p.Body) > 0 {
+		var ack proto.AckNotice
+		if err := p.BindBody(&ack); err != nil {
+			return err
+		}
+		if ack.Code != proto.CODE_OK {
+			return fmt.Errorf("cmd %d refused: %s", cmd, ack.Info)
+		}
+	}
+	return nil
+}
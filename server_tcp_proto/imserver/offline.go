@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	log "github.com/thinkboy/log4go"
+)
+
+var (
+	offline *Offline
+
+	ErrOfflineEntry = errors.New("malformed offline entry")
+)
+
+// offlineKey is a sorted set of "id:entry" scored by id, offlineIDKey the
+// id counter of the user.
+func offlineKey(userID uint32) string {
+	return fmt.Sprintf("offline:%d", userID)
+}
+
+func offlineIDKey(userID uint32) string {
+	return fmt.Sprintf("offline:%d:id", userID)
+}
+
+// storeScript appends ARGV[1] with the next id, keeps the newest ARGV[2]
+// entries and refreshes the ttl.
+var storeScript = redis.NewScript(2, `
+local id = redis.call("INCR", KEYS[2])
+redis.call("ZADD", KEYS[1], id, id .. ":" .. ARGV[1])
+redis.call("ZREMRANGEBYRANK", KEYS[1], 0, -tonumber(ARGV[2]) - 1)
+redis.call("EXPIRE", KEYS[1], ARGV[3])
+redis.call("EXPIRE", KEYS[2], ARGV[3])
+return id`)
+
+type offlineEntry struct {
+	Cmd  int32           `json:"cmd"`
+	Body json.RawMessage `json:"body"`
+}
+
+// pushBodies builds the body of a stored or forwarded push by cmd.
+var pushBodies = map[int32]func() interface{}{
+	CMD_PUSH_NOTICE_FRIEND: newReqNoticeFriend,
+	CMD_PUSH_NOTICE_GROUP:  newReqNoticeGroup,
+}
+
+// Offline keeps the pushes of users who are not connected in redis until
+// they come back and ack them.
+type Offline struct {
+	pool *redis.Pool
+	max  int
+	ttl  time.Duration
+}
+
+func NewOffline(pool *redis.Pool, max int, ttl time.Duration) *Offline {
+	if max <= 0 {
+		max = 1
+	}
+	return &Offline{pool: pool, max: max, ttl: ttl}
+}
+
+// Store keeps body as cmd for every user of userIDs, in one round trip.
+func (o *Offline) Store(userIDs []uint32, cmd int32, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	entry, err := json.Marshal(&offlineEntry{Cmd: cmd, Body: b})
+	if err != nil {
+		return err
+	}
+	ttl := int64(o.ttl / time.Second)
+	if ttl <= 0 {
+		ttl = 1
+	}
+	conn := o.pool.Get()
+	defer conn.Close()
+	// pipelined EVALSHA needs the script cached.
+	if err = storeScript.Load(conn); err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		if err = storeScript.SendHash(conn, offlineKey(userID), offlineIDKey(userID), entry, o.max, ttl); err != nil {
+			return err
+		}
+	}
+	if err = conn.Flush(); err != nil {
+		return err
+	}
+	for range userIDs {
+		if _, e := conn.Receive(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Deliver pushes the stored messages of the user of s oldest first, they stay
+// stored until the client acks them through s.
+func (o *Offline) Deliver(s *Session) (n int, err error) {
+	conn := o.pool.Get()
+	vs, err := redis.Strings(conn.Do("ZRANGE", offlineKey(s.UserID()), 0, -1))
+	conn.Close()
+	if err != nil {
+		return
+	}
+	for _, v := range vs {
+		var (
+			id    uint64
+			cmd   int32
+			body  interface{}
+			entry offlineEntry
+		)
+		i := strings.IndexByte(v, ':')
+		if i < 0 {
+			return n, ErrOfflineEntry
+		}
+		if id, err = strconv.ParseUint(v[:i], 10, 64); err != nil {
+			return
+		}
+		if err = json.Unmarshal([]byte(v[i+1:]), &entry); err != nil {
+			return
+		}
+		if cmd = entry.Cmd; pushBodies[cmd] == nil {
+			log.Warn("user %d offline message %d unknown cmd %d", s.UserID(), id, cmd)
+			continue
+		}
+		body = pushBodies[cmd]()
+		if err = json.Unmarshal(entry.Body, body); err != nil {
+			return
+		}
+		if err = s.Deliver(cmd, body, id); err != nil {
+			return
+		}
+		n++
+	}
+	return
+}
+
+// Ack drops the stored message id of userID.
+func (o *Offline) Ack(userID uint32, id uint64) error {
+	conn := o.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("ZREMRANGEBYSCORE", offlineKey(userID), id, id)
+	return err
+}
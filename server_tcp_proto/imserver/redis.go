@@ -0,0 +1,22 @@
+package main
+
+import (
+	"go-test/storage/cache"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	// redisPool serves groups, offline messages, the cluster and revoked
+	// tokens, nil without redis.addr.
+	redisPool *redis.Pool
+)
+
+func initRedis() {
+	if Conf.RedisAddr == "" {
+		return
+	}
+	redisPool = cache.NewPool(Conf.RedisAddr, Conf.RedisIdle, Conf.RedisActive, Conf.RedisIdleTimeout)
+	groups = NewGroups(redisPool)
+	offline = NewOffline(redisPool, Conf.OfflineMax, Conf.OfflineTTL)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+
+	"go-test/proto"
+
+	log "github.com/thinkboy/log4go"
+)
+
+// Context is one request, Req and its body are only valid in the handler.
+type Context struct {
+	Req     *proto.Proto
+	Session *Session
+
+	afterAck func()
+}
+
+// AfterAck runs fn once the ack is queued, what fn pushes reaches the client
+// after it.
+func (c *Context) AfterAck(fn func()) {
+	c.afterAck = fn
+}
+
+// HandlerFunc gets the decoded request body and returns the ack body.
+type HandlerFunc func(c *Context, req interface{}) (ack interface{}, err error)
+
+// CodeError lets a handler fail with its own AckNotice.Code, any other
+// error is acked as proto.CODE_FAILED.
+type CodeError struct {
+	Code int
+	Info string
+}
+
+func (e *CodeError) Error() string {
+	return e.Info
+}
+
+type route struct {
+	ackCmd  int32
+	newReq  func() interface{}
+	handler HandlerFunc
+}
+
+type Router struct {
+	routes      map[int32]*route
+	middlewares []Middleware
+}
+
+func NewRouter() *Router {
+	return &Router{routes: make(map[int32]*route)}
+}
+
+// Use appends middlewares, the first one is the outermost. Only handlers
+// registered after Use are wrapped.
+func (r *Router) Use(m ...Middleware) {
+	r.middlewares = append(r.middlewares, m...)
+}
+
+// Handle routes reqCmd to h and acks with ackCmd, the body is decoded into
+// the value newReq makes (nil when the request has no body).
+func (r *Router) Handle(reqCmd, ackCmd int32, newReq func() interface{}, h HandlerFunc) {
+	for i := len(r.middlewares) - 1; i >= 0; i-- {
+		h = r.middlewares[i](h)
+	}
+	r.routes[reqCmd] = &route{ackCmd: ackCmd, newReq: newReq, handler: h}
+}
+
+// Dispatch runs the handler of p.Cmd and writes its ack, unknown cmds and
+// failures get an error AckNotice. Only write errors are returned.
+func (r *Router) Dispatch(s *Session, p *proto.Proto) (err error) {
+	ack := &proto.Proto{Ver: p.Ver, SeqId: p.SeqId}
+	rt, ok := r.routes[p.Cmd]
+	if !ok {
+		log.Warn("unknown cmd %d", p.Cmd)
+		// every ack cmd is its request cmd + 1.
+		ack.Cmd = p.Cmd + 1
+		return SendAck(s, ack, &proto.AckNotice{Code: proto.CODE_UNKNOWN_CMD, Info: "unknown cmd"})
+	}
+
+	ack.Cmd = rt.ackCmd
+	var req interface{}
+	if rt.newReq != nil {
+		req = rt.newReq()
+		if err = bindBody(p, req); err != nil {
+			log.Warn("cmd %d p.BindBody() error(%v)", p.Cmd, err)
+			return SendAck(s, ack, &proto.AckNotice{Code: proto.CODE_BAD_BODY, Info: err.Error()})
+		}
+	}
+	c := &Context{Req: p, Session: s}
+	body, err := rt.handler(c, req)
+	if err != nil {
+		return SendAck(s, ack, errorAck(err))
+	}
+	if err = SendAck(s, ack, body); err == nil && c.afterAck != nil {
+		c.afterAck()
+	}
+	return
+}
+
+// bindBody is p.BindBody out of reach of Recovery, a codec panicking on a
+// malformed body makes it a bad body.
+func bindBody(p *proto.Proto, req interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error("cmd %d seq %d p.BindBody() panic(%v)\n%s", p.Cmd, p.SeqId, r, debug.Stack())
+			err = fmt.Errorf("malformed body: %v", r)
+		}
+	}()
+	return p.BindBody(req)
+}
+
+func errorAck(err error) *proto.AckNotice {
+	if e, ok := err.(*CodeError); ok {
+		return &proto.AckNotice{Code: e.Code, Info: e.Info}
+	}
+	return &proto.AckNotice{Code: proto.CODE_FAILED, Info: err.Error()}
+}
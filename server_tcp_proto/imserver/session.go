@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"go-test/common/timer"
+	"go-test/proto"
+)
+
+const (
+	registryBuckets = 32
+)
+
+var (
+	sessionSeq int64
+	sessions   = NewRegistry()
+)
+
+// Session is one client connection, UserID is 0 until OP_AUTH binds it.
+// Only the connection goroutine reads, anyone may write through Push: the
+// packets queue up for the writer goroutine, the only user of enc.
+// Lazy sessions (epoll mode) start their writer only while packets are
+// queued and borrow their buffers, an idle one holds no goroutine.
+type Session struct {
+	ID     int64
+	userID uint32 // atomic, any goroutine may read it
+	conn   net.Conn
+	dec    *proto.Decoder
+	rd     *lazyReader // lazy sessions only
+
+	enc       *proto.Encoder
+	bw        flushWriter
+	out       chan outItem
+	quit      chan struct{} // closed by Close, the writer drains out and stops
+	done      chan struct{} // closed by the writer once the connection is closed, also when a write fails
+	closeOnce sync.Once
+
+	lazy    bool
+	qLock   sync.Mutex // guards the queue of a lazy session
+	qCond   *sync.Cond // signalled when the queue shrinks or the writer stops
+	queue   []outItem
+	writing bool // its writer goroutine runs
+	closing bool
+
+	encrypted bool  // the handshake is done, connection goroutine only
+	ver       int32 // the client's Ver, pushes use its body codec
+	headerLen int16 // last header layout and compression sent to the writer
+	compress  int16
+
+	pLock   sync.Mutex // guards the pushes waiting for an ack
+	msgSeq  uint64
+	pending map[uint64]*pending
+	closed  bool
+
+	wheel     *timer.Wheel
+	authTimer *timer.Timer
+	idleTimer *timer.Timer
+	evicted   int32 // why the timers closed the connection
+}
+
+func NewSession(conn net.Conn, lazy bool) *Session {
+	id := atomic.AddInt64(&sessionSeq, 1)
+	s := &Session{
+		ID:   id,
+		conn: conn,
+		lazy: lazy,
+
+		pending: make(map[uint64]*pending),
+		wheel:   wheelOf(id),
+	}
+	if lazy {
+		s.rd = &lazyReader{rd: conn}
+		s.dec = proto.NewDecoder(s.rd)
+		s.bw = &lazyWriter{wr: conn}
+		s.qCond = sync.NewCond(&s.qLock)
+	} else {
+		s.dec = proto.NewDecoder(bufio.NewReader(conn))
+		if _, ok := conn.(*proto.WebsocketConn); ok {
+			s.bw = packetWriter{conn}
+		} else {
+			s.bw = bufio.NewWriter(conn)
+		}
+		s.out = make(chan outItem, Conf.WriteQueue)
+		s.quit = make(chan struct{})
+		s.done = make(chan struct{})
+	}
+	// the writer flushes once per batch, not per packet, websocket sends
+	// every packet as a message of its own.
+	s.enc = proto.NewEncoder(writerOnly{s.bw})
+	if !lazy {
+		go s.writeLoop()
+	}
+	return s
+}
+
+// UserID is the user OP_AUTH bound the session to, 0 before.
+func (s *Session) UserID() uint32 {
+	return atomic.LoadUint32(&s.userID)
+}
+
+func (s *Session) RemoteAddr() string {
+	return s.conn.RemoteAddr().String()
+}
+
+// Push queues the reply p for the client, it waits while the queue is
+// full. p is not copied, its body must stay as is until written.
+func (s *Session) Push(p *proto.Proto) error {
+	return s.send(outItem{p: &proto.Proto{Ver: p.Ver, Cmd: p.Cmd, SeqId: p.SeqId, Body: p.Body}, reply: true})
+}
+
+// PushBody pushes body as cmd, marshalled with the client's body codec.
+func (s *Session) PushBody(cmd int32, body interface{}) error {
+	return s.push(newMessage(cmd, body))
+}
+
+func (s *Session) push(m *message) error {
+	p, err := m.proto(int16(atomic.LoadInt32(&s.ver)))
+	if err != nil {
+		return err
+	}
+	return s.send(outItem{p: p})
+}
+
+// follow replies in the header layout and Ver the client speaks, compressed
+// once it has shown it understands compression. Only the connection
+// goroutine calls it.
+func (s *Session) follow(ver int16) {
+	atomic.StoreInt32(&s.ver, int32(ver))
+	if n := s.dec.HeaderLen(); n != s.headerLen {
+		s.headerLen = n
+		s.send(outItem{apply: func(enc *proto.Encoder) { enc.SetHeaderLen(n) }})
+	}
+	if c := s.dec.Compress(); c != proto.CompressNone && c != s.compress {
+		s.compress = c
+		s.send(outItem{apply: func(enc *proto.Encoder) { enc.SetCompress(c, proto.DefaultCompressThreshold) }})
+	}
+}
+
+// setCipher packets queued from now on are encrypted.
+func (s *Session) setCipher(aead cipher.AEAD) {
+	s.encrypted = true
+	s.send(outItem{apply: func(enc *proto.Encoder) { enc.SetCipher(aead, proto.FromServer) }})
+	s.dec.SetCipher(aead, proto.FromClient)
+}
+
+// message is a push, its body is marshalled once per Ver. Pushes carry
+// SeqId 0, clients tell them from replies by that.
+type message struct {
+	cmd    int32
+	body   interface{}
+	protos map[int16]*proto.Proto
+}
+
+func newMessage(cmd int32, body interface{}) *message {
+	return &message{cmd: cmd, body: body}
+}
+
+func (m *message) proto(ver int16) (*proto.Proto, error) {
+	if p, ok := m.protos[ver]; ok {
+		return p, nil
+	}
+	p := &proto.Proto{Ver: ver, Cmd: m.cmd}
+	if err := p.SetBody(m.body); err != nil {
+		return nil, err
+	}
+	if m.protos == nil {
+		m.protos = make(map[int16]*proto.Proto)
+	}
+	m.protos[ver] = p
+	return p, nil
+}
+
+type bucket struct {
+	lock     sync.RWMutex
+	sessions map[int64]*Session
+	users    map[uint32]map[int64]*Session // one user may be online on several devices
+}
+
+// Registry holds the online sessions by connection ID and by user ID,
+// split in buckets to keep lock contention low.
+type Registry struct {
+	buckets [registryBuckets]bucket
+}
+
+func NewRegistry() *Registry {
+	r := new(Registry)
+	for i := range r.buckets {
+		r.buckets[i].sessions = make(map[int64]*Session)
+		r.buckets[i].users = make(map[uint32]map[int64]*Session)
+	}
+	return r
+}
+
+func (r *Registry) sessionBucket(id int64) *bucket {
+	return &r.buckets[uint64(id)%registryBuckets]
+}
+
+func (r *Registry) userBucket(userID uint32) *bucket {
+	return &r.buckets[userID%registryBuckets]
+}
+
+func (r *Registry) Add(s *Session) {
+	b := r.sessionBucket(s.ID)
+	b.lock.Lock()
+	b.sessions[s.ID] = s
+	b.lock.Unlock()
+}
+
+// Bind files s under userID, a session binds once.
+func (r *Registry) Bind(s *Session, userID uint32) {
+	atomic.StoreUint32(&s.userID, userID)
+	b := r.userBucket(userID)
+	b.lock.Lock()
+	us, ok := b.users[userID]
+	if !ok {
+		us = make(map[int64]*Session)
+		b.users[userID] = us
+	}
+	us[s.ID] = s
+	b.lock.Unlock()
+}
+
+func (r *Registry) Remove(s *Session) {
+	b := r.sessionBucket(s.ID)
+	b.lock.Lock()
+	delete(b.sessions, s.ID)
+	b.lock.Unlock()
+	userID := s.UserID()
+	if userID == 0 {
+		return
+	}
+	b = r.userBucket(userID)
+	b.lock.Lock()
+	if us, ok := b.users[userID]; ok {
+		if delete(us, s.ID); len(us) == 0 {
+			delete(b.users, userID)
+		}
+	}
+	b.lock.Unlock()
+}
+
+// Session looks a connection up by ID.
+func (r *Registry) Session(id int64) *Session {
+	b := r.sessionBucket(id)
+	b.lock.RLock()
+	s := b.sessions[id]
+	b.lock.RUnlock()
+	return s
+}
+
+// User returns the sessions of userID.
+func (r *Registry) User(userID uint32) []*Session {
+	b := r.userBucket(userID)
+	b.lock.RLock()
+	us := b.users[userID]
+	ss := make([]*Session, 0, len(us))
+	for _, s := range us {
+		ss = append(ss, s)
+	}
+	b.lock.RUnlock()
+	return ss
+}
+
+// Online tells whether userID has a session here.
+func (r *Registry) Online(userID uint32) bool {
+	b := r.userBucket(userID)
+	b.lock.RLock()
+	_, ok := b.users[userID]
+	b.lock.RUnlock()
+	return ok
+}
+
+// PushUser pushes body as cmd to every session of userID, returns how
+// many sessions got it.
+func (r *Registry) PushUser(userID uint32, cmd int32, body interface{}) int {
+	return r.pushUser(userID, newMessage(cmd, body))
+}
+
+func (r *Registry) pushUser(userID uint32, m *message) (n int) {
+	for _, s := range r.User(userID) {
+		if err := s.push(m); err == nil {
+			n++
+		}
+	}
+	return
+}
+
+// DeliverUser pushes body as cmd to every session of userID, each session
+// retransmits it until the client acks, returns how many sessions got it.
+func (r *Registry) DeliverUser(userID uint32, cmd int32, body interface{}) (n int) {
+	up := new(userPush)
+	for _, s := range r.User(userID) {
+		if err := s.deliver(cmd, body, 0, up); err == nil {
+			n++
+		}
+	}
+	return
+}
+
+// PushUsers pushes body as cmd to every session of userIDs, returns how
+// many sessions got it.
+func (r *Registry) PushUsers(userIDs []uint32, cmd int32, body interface{}) (n int) {
+	m := newMessage(cmd, body)
+	for _, userID := range userIDs {
+		n += r.pushUser(userID, m)
+	}
+	return
+}
+
+// Broadcast pushes body as cmd to every session, authenticated or not.
+func (r *Registry) Broadcast(cmd int32, body interface{}) (n int) {
+	m := newMessage(cmd, body)
+	for _, s := range r.All() {
+		if err := s.push(m); err == nil {
+			n++
+		}
+	}
+	return
+}
+
+// Users are the users online here.
+func (r *Registry) Users() []uint32 {
+	var userIDs []uint32
+	for i := range r.buckets {
+		b := &r.buckets[i]
+		b.lock.RLock()
+		for userID := range b.users {
+			userIDs = append(userIDs, userID)
+		}
+		b.lock.RUnlock()
+	}
+	return userIDs
+}
+
+// All returns every session.
+func (r *Registry) All() []*Session {
+	var ss []*Session
+	for i := range r.buckets {
+		b := &r.buckets[i]
+		b.lock.RLock()
+		for _, s := range b.sessions {
+			ss = append(ss, s)
+		}
+		b.lock.RUnlock()
+	}
+	return ss
+}
+
+// Count is the number of sessions.
+func (r *Registry) Count() (n int) {
+	for i := range r.buckets {
+		b := &r.buckets[i]
+		b.lock.RLock()
+		n += len(b.sessions)
+		b.lock.RUnlock()
+	}
+	return
+}
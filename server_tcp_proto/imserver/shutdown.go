@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"go-test/proto"
+
+	log "github.com/thinkboy/log4go"
+)
+
+var (
+	closing  int32
+	closers  []io.Closer // listeners, registered before the signal
+	pipes    int64       // connections still open
+	inflight int64       // requests being handled
+)
+
+func addCloser(c io.Closer) {
+	closers = append(closers, c)
+}
+
+func shuttingDown() bool {
+	return atomic.LoadInt32(&closing) == 1
+}
+
+// beginRequest counts a request in, false once shutdown started: the
+// request is dropped, the client has been told to go.
+func beginRequest() bool {
+	atomic.AddInt64(&inflight, 1)
+	if shuttingDown() {
+		atomic.AddInt64(&inflight, -1)
+		return false
+	}
+	return true
+}
+
+func endRequest() {
+	atomic.AddInt64(&inflight, -1)
+}
+
+// goRequest runs fn in the background of the request being handled,
+// shutdown waits for it like for the request.
+func goRequest(fn func()) {
+	atomic.AddInt64(&inflight, 1)
+	go func() {
+		defer endRequest()
+		fn()
+	}()
+}
+
+// waitZero polls n until it is 0 or the deadline passes.
+func waitZero(n *int64, deadline time.Time) bool {
+	for atomic.LoadInt64(n) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// shutdown stops accepting, tells every client to go with
+// OP_DISCONNECT_REPLY, lets the requests being handled and their background
+// work finish and closes the connections once their writes are out, all at
+// once: a client that does not read holds up only its own. Pushes never
+// acked are stored offline by the connection goroutines. It gives up on
+// anything still running after shutdown.timeout.
+func shutdown() {
+	atomic.StoreInt32(&closing, 1)
+	deadline := time.Now().Add(Conf.ShutdownTimeout)
+	for _, c := range closers {
+		c.Close()
+	}
+	n := sessions.Broadcast(proto.OP_DISCONNECT_REPLY, &proto.AckNotice{Code: proto.CODE_OK, Info: "server shutdown"})
+	log.Info("shutdown, %d sessions told to disconnect", n)
+	if !waitZero(&inflight, deadline) {
+		log.Warn("shutdown, %d requests still running", atomic.LoadInt64(&inflight))
+	}
+	for _, s := range sessions.All() {
+		go s.Close()
+	}
+	if !waitZero(&pipes, deadline) {
+		log.Warn("shutdown, %d connections still running", atomic.LoadInt64(&pipes))
+	}
+	for _, w := range wheels {
+		w.Stop()
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+
+	"go-test/common/sockopt"
+
+	log "github.com/thinkboy/log4go"
+)
+
+var (
+	// lastSockOpt is what the kernel made of the [tcp] options on the last
+	// accepted connection, logged with the cmd stats.
+	lastSockOpt atomic.Value // *sockopt.Effective
+)
+
+// tune applies the [tcp] socket options to an accepted connection, a
+// refused option is logged and the connection served as it is.
+func tune(conn *net.TCPConn) {
+	if err := sockopt.Apply(conn, Conf.SockOptions()); err != nil {
+		log.Warn("sockopt.Apply(\"%s\") error(%v)", conn.RemoteAddr().String(), err)
+	}
+	e, err := sockopt.Read(conn)
+	if err != nil {
+		return
+	}
+	lastSockOpt.Store(e)
+	log.Debug("%s socket %s", conn.RemoteAddr().String(), e)
+}
+
+// tunedListener tunes the connections it accepts, for the tls and websocket
+// listeners.
+type tunedListener struct {
+	*net.TCPListener
+}
+
+func listenTuned(addr string) (net.Listener, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return tunedListener{ln}, nil
+}
+
+func (ln tunedListener) Accept() (net.Conn, error) {
+	conn, err := ln.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	tune(conn)
+	return conn, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"go-test/common/timer"
+)
+
+const (
+	timerTick  = 100 * time.Millisecond
+	timerSlots = 1024 // one turn is about 100s
+
+	evictIdle = 1
+	evictAuth = 2
+	evictSlow = 3 // its write queue is full
+)
+
+var (
+	wheels []*timer.Wheel
+)
+
+// initTimers starts a timing wheel per cpu, sessions spread over them so
+// their timers do not all contend for one lock.
+func initTimers() {
+	wheels = make([]*timer.Wheel, runtime.NumCPU())
+	for i := range wheels {
+		wheels[i] = timer.New(timerTick, timerSlots)
+	}
+}
+
+func wheelOf(id int64) *timer.Wheel {
+	return wheels[uint64(id)%uint64(len(wheels))]
+}
+
+// startTimers arms the auth and idle timers of a new session.
+func (s *Session) startTimers() {
+	s.authTimer = s.wheel.AfterFunc(Conf.HandshakeTimeout, func() { s.evict(evictAuth) })
+	s.idleTimer = s.wheel.AfterFunc(Conf.HeartbeatTimeout, func() { s.evict(evictIdle) })
+}
+
+func (s *Session) stopTimers() {
+	s.authTimer.Stop()
+	s.idleTimer.Stop()
+}
+
+// evict closes the connection, the connection goroutine logs why. It
+// reports whether this call did it.
+func (s *Session) evict(reason int32) bool {
+	if !atomic.CompareAndSwapInt32(&s.evicted, 0, reason) {
+		return false
+	}
+	s.conn.Close()
+	return true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+
+	log "github.com/thinkboy/log4go"
+)
+
+var (
+	ErrClientCA = errors.New("no certificate in client ca file")
+)
+
+func newTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(Conf.CertFile, Conf.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if Conf.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(Conf.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrClientCA
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// initTLS serves the same protocol over tls on tls.addr.
+func initTLS() error {
+	if Conf.TLSAddr == "" {
+		return nil
+	}
+	cfg, err := newTLSConfig()
+	if err != nil {
+		return err
+	}
+	ln, err := listenTuned(Conf.TLSAddr)
+	if err != nil {
+		return err
+	}
+	ln = tls.NewListener(ln, cfg)
+	log.Info("tls server = %s", Conf.TLSAddr)
+	addCloser(ln)
+	go acceptTLS(ln)
+	return nil
+}
+
+func acceptTLS(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if shuttingDown() {
+				return
+			}
+			continue
+		}
+		if !admit(conn) {
+			continue
+		}
+
+		log.Debug("a tls client connect: %s", conn.RemoteAddr().String())
+		go tcpPipe(conn)
+	}
+}
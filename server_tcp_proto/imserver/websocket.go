@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+
+	"go-test/proto"
+
+	"github.com/gorilla/websocket"
+	log "github.com/thinkboy/log4go"
+)
+
+var (
+	upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		// browsers and mini programs connect from any origin.
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+)
+
+// initWebsocket serves the protocol as binary messages on ws://addr/sub and
+// wss://addr/sub, wss shares the tls settings of the tcp tls listener.
+func initWebsocket() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sub", serveWebsocket)
+	if Conf.WebsocketAddr != "" {
+		ln, err := listenTuned(Conf.WebsocketAddr)
+		if err != nil {
+			return err
+		}
+		srv := &http.Server{Handler: mux}
+		log.Info("websocket server = %s", Conf.WebsocketAddr)
+		addCloser(srv)
+		go func() {
+			if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				log.Error("srv.Serve(\"%s\") error(%v)", Conf.WebsocketAddr, err)
+			}
+		}()
+	}
+	if Conf.WebsocketTLSAddr != "" {
+		cfg, err := newTLSConfig()
+		if err != nil {
+			return err
+		}
+		ln, err := listenTuned(Conf.WebsocketTLSAddr)
+		if err != nil {
+			return err
+		}
+		srv := &http.Server{Handler: mux, TLSConfig: cfg}
+		log.Info("websocket tls server = %s", Conf.WebsocketTLSAddr)
+		addCloser(srv)
+		go func() {
+			if err := srv.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+				log.Error("srv.ServeTLS(\"%s\") error(%v)", Conf.WebsocketTLSAddr, err)
+			}
+		}()
+	}
+	return nil
+}
+
+func serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Error("upgrader.Upgrade() error(%v)", err)
+		return
+	}
+
+	conn := proto.NewWebsocketConn(ws)
+	if !admit(conn) {
+		return
+	}
+
+	log.Debug("a websocket client connect: %s", ws.RemoteAddr().String())
+	tcpPipe(conn)
+}
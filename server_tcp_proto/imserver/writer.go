@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"go-test/proto"
+
+	log "github.com/thinkboy/log4go"
+)
+
+const (
+	fullDrop       = "drop"
+	fullBlock      = "block"
+	fullDisconnect = "disconnect"
+
+	// at most writeBatch queued packets go out with one flush.
+	writeBatch = 64
+)
+
+var (
+	// counters of the full queue policies, logged with the cmd stats.
+	outDropped uint64 // packets dropped
+	outBlocked uint64 // senders that had to wait
+	outEvicted uint64 // sessions disconnected
+
+	ErrQueueFull = errors.New("write queue full")
+)
+
+// outItem is a packet to write, or a change of the encoder settings which
+// has to happen between the packets queued before and after it.
+type outItem struct {
+	p     *proto.Proto
+	apply func(enc *proto.Encoder)
+	reply bool // answers a request of the client
+}
+
+// writerOnly hides Flush from the encoder.
+type writerOnly struct {
+	io.Writer
+}
+
+// packetWriter writes each packet as it comes, a websocket conn sends every
+// Write as one message and clients read one packet per message.
+type packetWriter struct {
+	io.Writer
+}
+
+func (packetWriter) Flush() error {
+	return nil
+}
+
+// fullPolicy is how a full queue takes it. Encoder changes are never
+// dropped, nor are replies: a client pipelining requests waits for its own
+// replies, only pushes it does not read count as a slow client.
+func fullPolicy(it outItem) string {
+	if it.apply != nil || it.reply {
+		return fullBlock
+	}
+	return Conf.WriteFull
+}
+
+// send queues it, a full queue is handled by fullPolicy.
+func (s *Session) send(it outItem) error {
+	if s.lazy {
+		return s.sendLazy(it)
+	}
+	select {
+	case <-s.quit:
+		return ErrSessionClosed
+	case <-s.done:
+		return ErrSessionClosed
+	case s.out <- it:
+		return nil
+	default:
+	}
+	switch fullPolicy(it) {
+	case fullDrop:
+		atomic.AddUint64(&outDropped, 1)
+		return ErrQueueFull
+	case fullBlock:
+		atomic.AddUint64(&outBlocked, 1)
+		select {
+		case s.out <- it:
+			return nil
+		case <-s.quit:
+			return ErrSessionClosed
+		case <-s.done:
+			// the writer failed, nothing reads out any more.
+			return ErrSessionClosed
+		}
+	default:
+		if s.evict(evictSlow) {
+			atomic.AddUint64(&outEvicted, 1)
+		}
+		return ErrQueueFull
+	}
+}
+
+// writeLoop writes what is queued, as many packets as are waiting with one
+// flush. After Close it writes what is left and closes the connection.
+func (s *Session) writeLoop() {
+	defer close(s.done)
+	defer s.conn.Close()
+	for {
+		var it outItem
+		select {
+		case it = <-s.out:
+		case <-s.quit:
+			// set here, not in Close: a websocket conn takes no deadline
+			// next to a write.
+			s.conn.SetWriteDeadline(time.Now().Add(Conf.CloseTimeout))
+			s.drain()
+			return
+		}
+		err := s.write(it)
+		for n := 1; err == nil && n < writeBatch && len(s.out) > 0; n++ {
+			err = s.write(<-s.out)
+		}
+		if err == nil {
+			err = s.bw.Flush()
+		}
+		if err != nil {
+			log.Debug("session %d write error(%v)", s.ID, err)
+			return
+		}
+	}
+}
+
+func (s *Session) write(it outItem) error {
+	if it.apply != nil {
+		it.apply(s.enc)
+		return nil
+	}
+	return s.enc.Encode(it.p)
+}
+
+// drain writes what was queued before Close.
+func (s *Session) drain() {
+	for {
+		select {
+		case it := <-s.out:
+			if err := s.write(it); err != nil {
+				return
+			}
+		default:
+			s.bw.Flush()
+			return
+		}
+	}
+}
+
+// Close lets the writer write out the queue within Conf.CloseTimeout and close
+// the connection, it returns once the connection is closed.
+func (s *Session) Close() error {
+	if s.lazy {
+		return s.closeLazy()
+	}
+	s.closeOnce.Do(func() { close(s.quit) })
+	t := time.NewTimer(Conf.CloseTimeout)
+	defer t.Stop()
+	select {
+	case <-s.done:
+	case <-t.C:
+		// the writer is stuck in a write it began before quit, closing the
+		// connection ends it: Close is safe next to a write.
+		s.conn.Close()
+		<-s.done
+	}
+	return nil
+}
+
+// sendLazy is send of a lazy session, its writer is started when the queue
+// gets its first packet.
+func (s *Session) sendLazy(it outItem) error {
+	s.qLock.Lock()
+	if !s.closing && len(s.queue) >= Conf.WriteQueue {
+		switch fullPolicy(it) {
+		case fullDrop:
+			s.qLock.Unlock()
+			atomic.AddUint64(&outDropped, 1)
+			return ErrQueueFull
+		case fullBlock:
+			atomic.AddUint64(&outBlocked, 1)
+			for !s.closing && len(s.queue) >= Conf.WriteQueue {
+				s.qCond.Wait()
+			}
+		default:
+			s.qLock.Unlock()
+			if s.evict(evictSlow) {
+				atomic.AddUint64(&outEvicted, 1)
+			}
+			return ErrQueueFull
+		}
+	}
+	if s.closing {
+		s.qLock.Unlock()
+		return ErrSessionClosed
+	}
+	s.queue = append(s.queue, it)
+	if !s.writing {
+		s.writing = true
+		go s.writeLazy()
+	}
+	s.qLock.Unlock()
+	return nil
+}
+
+// writeLazy writes the queue in batches of writeBatch and stops once it is
+// empty, the flush hands the write buffer back and the encoder its buffers.
+func (s *Session) writeLazy() {
+	for {
+		s.qLock.Lock()
+		n := len(s.queue)
+		if n == 0 {
+			// still the only writer: the next starts once writing is false.
+			s.enc.Release()
+			s.queue = nil
+			s.writing = false
+			s.qCond.Broadcast()
+			s.qLock.Unlock()
+			return
+		}
+		if n > writeBatch {
+			n = writeBatch
+		}
+		batch := make([]outItem, n)
+		copy(batch, s.queue)
+		s.queue = s.queue[n:]
+		s.qCond.Broadcast()
+		s.qLock.Unlock()
+
+		var err error
+		for _, it := range batch {
+			if err = s.write(it); err != nil {
+				break
+			}
+		}
+		if ferr := s.bw.Flush(); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			log.Debug("session %d write error(%v)", s.ID, err)
+			s.qLock.Lock()
+			s.closing = true
+			s.queue = nil
+			s.writing = false
+			s.qCond.Broadcast()
+			s.qLock.Unlock()
+			s.conn.Close()
+			return
+		}
+	}
+}
+
+// closeLazy waits for the writer to write out the queue, then closes the
+// connection.
+func (s *Session) closeLazy() error {
+	s.qLock.Lock()
+	if !s.closing {
+		s.closing = true
+		s.conn.SetWriteDeadline(time.Now().Add(Conf.CloseTimeout))
+		s.qCond.Broadcast()
+	}
+	for s.writing {
+		s.qCond.Wait()
+	}
+	s.qLock.Unlock()
+	return s.conn.Close()
+}
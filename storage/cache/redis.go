@@ -26,6 +26,12 @@ func InitRedis(strHost string) {
 	RedisClients = createPool(IDLE_COUNT, ACTIVE_COUNT, IDLE_TIMEOUT, strHost)
 }
 
+// NewPool is a pool of at most maxActive connections to strHost, 0 is no
+// limit, keeping maxIdle unused ones for idleTimeout.
+func NewPool(strHost string, maxIdle, maxActive int, idleTimeout time.Duration) *redis.Pool {
+	return createPool(maxIdle, maxActive, int(idleTimeout/time.Second), strHost)
+}
+
 func createPool(iMaxIdle, iMaxActive, iIdleTimeout int, strAddr string) (pool *redis.Pool) {
 	pool = new(redis.Pool)
 	pool.MaxIdle = iMaxIdle
@@ -0,0 +1,120 @@
+/*
+token service, it issues the IM tokens imclient sends in OP_AUTH and
+revokes them. imserver verifies them with the same auth.key and redis.
+
+	go run main.go -auth.key secret -api.key internal
+	curl -H 'X-Api-Key: internal' -d 'user_id=11&device=imclient' http://127.0.0.1:1211/token
+	curl -H 'X-Api-Key: internal' -d 'token=...' http://127.0.0.1:1211/revoke
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go-test/common/token"
+	"go-test/storage/cache"
+)
+
+var (
+	addr      string
+	authKey   string
+	apiKey    string
+	redisAddr string
+	tokenTTL  time.Duration
+
+	verifier *token.Verifier
+)
+
+type response struct {
+	Code   int    `json:"code"`
+	Info   string `json:"info"`
+	Token  string `json:"token,omitempty"`
+	Expire int64  `json:"expire,omitempty"`
+}
+
+func main() {
+	flag.StringVar(&addr, "addr", ":1211", " set listen address")
+	flag.StringVar(&authKey, "auth.key", "", " set the hmac key tokens are signed with, imserver auth.key")
+	flag.StringVar(&apiKey, "api.key", "", " set the X-Api-Key callers must send")
+	flag.StringVar(&redisAddr, "redis.addr", "127.0.0.1:6379", " set redis address of the revoked tokens blacklist")
+	flag.DurationVar(&tokenTTL, "token.ttl", 24*time.Hour, " set how long a token is valid")
+	flag.Parse()
+	if authKey == "" {
+		log.Fatal("no -auth.key")
+	}
+	if apiKey == "" {
+		log.Fatal("no -api.key")
+	}
+
+	cache.InitRedis(redisAddr)
+	verifier = &token.Verifier{Key: []byte(authKey), Pool: cache.RedisClients}
+
+	http.HandleFunc("/token", issue)
+	http.HandleFunc("/revoke", revoke)
+	log.Printf("start token server, addr: %s.", addr)
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
+
+func reply(w http.ResponseWriter, status int, res *response) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// allowed only lets POSTs with the api key through.
+func allowed(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		reply(w, http.StatusMethodNotAllowed, &response{Code: 1, Info: "POST only"})
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Api-Key")), []byte(apiKey)) != 1 {
+		reply(w, http.StatusUnauthorized, &response{Code: 1, Info: "bad api key"})
+		return false
+	}
+	return true
+}
+
+// issue signs a token for user_id on device.
+func issue(w http.ResponseWriter, r *http.Request) {
+	if !allowed(w, r) {
+		return
+	}
+	userID, err := strconv.ParseUint(r.FormValue("user_id"), 10, 32)
+	if err != nil || userID == 0 {
+		reply(w, http.StatusBadRequest, &response{Code: 1, Info: "bad user_id"})
+		return
+	}
+	now := time.Now()
+	c := &token.Claims{
+		UserID:   uint32(userID),
+		Device:   r.FormValue("device"),
+		IssuedAt: now,
+		Expire:   now.Add(tokenTTL),
+	}
+	log.Printf("issue token, user: %d device: %s", c.UserID, c.Device)
+	reply(w, http.StatusOK, &response{Info: "ok", Token: token.Sign(verifier.Key, c), Expire: c.Expire.Unix()})
+}
+
+// revoke blacklists the token until it expires.
+func revoke(w http.ResponseWriter, r *http.Request) {
+	if !allowed(w, r) {
+		return
+	}
+	if err := verifier.Revoke(r.FormValue("token"), time.Now()); err != nil {
+		status := http.StatusBadRequest
+		if err != token.ErrToken && err != token.ErrSignature && err != token.ErrExpired {
+			status = http.StatusInternalServerError
+		}
+		log.Printf("revoke token error(%v)", err)
+		reply(w, status, &response{Code: 1, Info: err.Error()})
+		return
+	}
+	reply(w, http.StatusOK, &response{Info: "ok"})
+}
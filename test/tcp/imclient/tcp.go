@@ -2,12 +2,13 @@ package main
 
 import (
 	"bufio"
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"net"
 	"time"
 
+	"go-test/proto"
+
 	log "github.com/thinkboy/log4go"
 )
 
@@ -38,14 +39,14 @@ func initTCP() {
 	log.Trace(Conf.TCPAddr)
 
 	seqId := int32(0)
-	wr := bufio.NewWriter(conn)
-	rd := bufio.NewReader(conn)
-	proto := new(Proto)
-	proto.Ver = 1
+	enc := proto.NewEncoder(bufio.NewWriter(conn))
+	dec := proto.NewDecoder(bufio.NewReader(conn))
+	p := new(proto.Proto)
+	p.Ver = 1
 
 	// writer
 	go func() {
-		proto1 := new(Proto)
+		proto1 := new(proto.Proto)
 
 		proto1.Ver = 1
 		for {
@@ -61,8 +62,8 @@ func initTCP() {
 			proto1.Cmd = OP_TEST_REATION_USER
 			proto1.SeqId = seqId
 			//proto1.Body = nil
-			if err = tcpWriteProto(wr, proto1); err != nil {
-				log.Error("tcpWriteProto() error(%v)", err)
+			if err = enc.Encode(proto1); err != nil {
+				log.Error("enc.Encode() error(%v)", err)
 				return
 			}
 			seqId++
@@ -71,118 +72,31 @@ func initTCP() {
 	}()
 	// reader
 	for {
-		log.Debug("tcpReadProto")
-
-		if err = tcpReadProto(rd, proto); err != nil {
-			log.Error("tcpReadProto() error(%v)", err)
+		if err = dec.Decode(p); err != nil {
+			log.Error("dec.Decode() error(%v)", err)
 			return
 		}
+		log.Debug("read proto: %s", p)
 
-		if proto.Cmd == OP_TEST_REATION_USER_REPLY {
+		if p.Cmd == OP_TEST_REATION_USER_REPLY {
 			log.Debug("ack relation user-----")
 			var oObj AckRelationUser
-			body, _ := proto.Body.MarshalJSON()
+			body, _ := p.Body.MarshalJSON()
 			if err := json.Unmarshal(body, &oObj); err != nil {
 				log.Error(err)
 			}
 
 			log.Debug("body = %v", oObj)
-		} else if proto.Cmd == OP_HEARTBEAT_REPLY {
+		} else if p.Cmd == OP_HEARTBEAT_REPLY {
 			log.Debug("receive heartbeat")
 			if err = conn.SetReadDeadline(time.Now().Add(25 * time.Second)); err != nil {
 				log.Error("conn.SetReadDeadline() error(%v)", err)
 				return
 			}
-		} else if proto.Cmd == OP_TEST_REPLY {
-			log.Debug("body: %s", string(proto.Body))
-		} else if proto.Cmd == OP_SEND_SMS_REPLY {
-			log.Debug("body: %s", string(proto.Body))
-		}
-	}
-}
-
-func tcpWriteProto(wr *bufio.Writer, proto *Proto) (err error) {
-	// write
-	log.Debug("packet len = %d", uint32(rawHeaderLen)+uint32(len(proto.Body)))
-	if err = binary.Write(wr, binary.BigEndian, uint32(rawHeaderLen)+uint32(len(proto.Body))); err != nil {
-		return
-	}
-	//if err = binary.Write(wr, binary.BigEndian, rawHeaderLen); err != nil {
-	//	return
-	//}
-
-	log.Debug("ver = %d", proto.Ver)
-	if err = binary.Write(wr, binary.BigEndian, proto.Ver); err != nil {
-		return
-	}
-
-	log.Debug("oper = %d", proto.Cmd)
-	if err = binary.Write(wr, binary.BigEndian, proto.Cmd); err != nil {
-		return
-	}
-
-	log.Debug("seqid = %d", proto.SeqId)
-	if err = binary.Write(wr, binary.BigEndian, proto.SeqId); err != nil {
-		return
-	}
-	if proto.Body != nil {
-		log.Debug("cipher body: %v", proto.Body)
-		if err = binary.Write(wr, binary.BigEndian, proto.Body); err != nil {
-			return
-		}
-	}
-	err = wr.Flush()
-	return
-}
-
-func tcpReadProto(rd *bufio.Reader, proto *Proto) (err error) {
-	var (
-		packLen int32
-	)
-	// read
-	if err = binary.Read(rd, binary.BigEndian, &packLen); err != nil {
-		return
-	}
-	/*
-		log.Debug("packLen: %d", packLen)
-		if err = binary.Read(rd, binary.BigEndian, &headerLen); err != nil {
-			return
-		}
-		log.Debug("headerLen: %d", headerLen)
-	*/
-	if err = binary.Read(rd, binary.BigEndian, &proto.Ver); err != nil {
-		return
-	}
-	log.Debug("ver: %d", proto.Ver)
-	if err = binary.Read(rd, binary.BigEndian, &proto.Cmd); err != nil {
-		return
-	}
-	log.Debug("operation: %d", proto.Cmd)
-	if err = binary.Read(rd, binary.BigEndian, &proto.SeqId); err != nil {
-		return
-	}
-	log.Debug("seqId: %d", proto.SeqId)
-	var (
-		n = int(0)
-		t = int(0)
-		//	bodyLen = int(packLen - int32(headerLen))
-		bodyLen = int(packLen - int32(rawHeaderLen))
-	)
-	log.Debug("read body len: %d", bodyLen)
-	if bodyLen > 0 {
-		proto.Body = make([]byte, bodyLen)
-		for {
-			if t, err = rd.Read(proto.Body[n:]); err != nil {
-				return
-			}
-			if n += t; n == bodyLen {
-				break
-			} else if n < bodyLen {
-			} else {
-			}
+		} else if p.Cmd == OP_TEST_REPLY {
+			log.Debug("body: %s", string(p.Body))
+		} else if p.Cmd == OP_SEND_SMS_REPLY {
+			log.Debug("body: %s", string(p.Body))
 		}
-	} else {
-		proto.Body = nil
 	}
-	return
 }